@@ -0,0 +1,253 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eliezedeck/gobase/logging"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+)
+
+// inboundVisitorIdleTime is how long the rate limit of a source IP is remembered after its last call
+const inboundVisitorIdleTime = 10 * time.Minute
+
+// AccessPolicy protects a Webhook from unwanted callers, by their IP address. The calls that are refused get a 403,
+// or a 429 when they are over the rate limit. It is not stored directly in the database but as a child/nested object
+// of the Webhook.
+type AccessPolicy struct {
+	// Allow lists the CIDRs, or single IPs, that may call the Webhook. AllowPresets adds the CIDRs of the named
+	// presets, see LoadIPPresets. Anyone may call if both are empty.
+	Allow        []string `bson:"allow"         json:"allow"`
+	AllowPresets []string `bson:"allowPresets"  json:"allowPresets"`
+	// Deny lists the CIDRs, or single IPs, that may never call the Webhook, even if they are allowed
+	Deny []string `bson:"deny"  json:"deny"`
+
+	// RequestsPerSecond is the rate of calls allowed from each source IP, 0 is unlimited
+	RequestsPerSecond float64 `bson:"requestsPerSecond"  json:"requestsPerSecond"`
+	// Burst is the number of calls a source IP can make at once, defaults to the RequestsPerSecond rounded up
+	Burst int `bson:"burst"  json:"burst"`
+
+	allow, deny []*net.IPNet
+}
+
+func (p *AccessPolicy) Verify() error {
+	if p.allow == nil || p.deny == nil {
+		// Parsed once and for all, the policy may be in use already
+		allow, err := parseCIDRs(p.Allow)
+		if err != nil {
+			return fmt.Errorf("access policy has an invalid allow list: %w", err)
+		}
+		deny, err := parseCIDRs(p.Deny)
+		if err != nil {
+			return fmt.Errorf("access policy has an invalid deny list: %w", err)
+		}
+		p.allow, p.deny = allow, deny
+	}
+	for _, name := range p.AllowPresets {
+		if _, found := ipPreset(name); !found {
+			return fmt.Errorf("access policy has an unknown preset: %s", name)
+		}
+	}
+	if p.RequestsPerSecond < 0 || p.Burst < 0 {
+		return fmt.Errorf("access policy rate limit must not be negative")
+	}
+	return nil
+}
+
+// refusal returns the reason why the IP may not call the Webhook, an empty string if it may. The policy must have been
+// verified.
+func (p *AccessPolicy) refusal(ip net.IP) string {
+	if containsIP(p.deny, ip) {
+		return "ip_denied"
+	}
+	if len(p.Allow) == 0 && len(p.AllowPresets) == 0 {
+		return ""
+	}
+	if containsIP(p.allow, ip) {
+		return ""
+	}
+	for _, name := range p.AllowPresets {
+		if preset, _ := ipPreset(name); containsIP(preset, ip) {
+			return ""
+		}
+	}
+	return "ip_not_allowed"
+}
+
+// parseCIDRs accepts single IPs as well, as if they were /32 or /128
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP: %s", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	// ipPresets are the named lists of CIDRs, such as the published ranges of GitHub or Stripe
+	ipPresets   = make(map[string][]*net.IPNet)
+	ipPresetsMu = &sync.RWMutex{}
+)
+
+func ipPreset(name string) ([]*net.IPNet, bool) {
+	ipPresetsMu.RLock()
+	defer ipPresetsMu.RUnlock()
+
+	preset, found := ipPresets[name]
+	return preset, found
+}
+
+// LoadIPPresets reads the presets that the AccessPolicy can refer to, from a YAML or JSON file mapping each name to
+// its CIDRs, e.g. `github: ["192.30.252.0/22", "185.199.108.0/22"]`. They replace the ones loaded before.
+func LoadIPPresets(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// JSON being YAML, both are read the same way
+	var document interface{}
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return fmt.Errorf("IP presets file %s: %w", path, err)
+	}
+	asJSON, err := json.Marshal(document)
+	if err != nil {
+		return fmt.Errorf("IP presets file %s: %w", path, err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(asJSON))
+	file := make(map[string][]string)
+	if err := decoder.Decode(&file); err != nil {
+		return fmt.Errorf("IP presets file %s: %w", path, err)
+	}
+
+	presets := make(map[string][]*net.IPNet, len(file))
+	for name, values := range file {
+		if presets[name], err = parseCIDRs(values); err != nil {
+			return fmt.Errorf("IP presets file %s: preset %s: %w", path, name, err)
+		}
+	}
+
+	ipPresetsMu.Lock()
+	ipPresets = presets
+	ipPresetsMu.Unlock()
+	logging.L.Info("IP presets have been loaded", zap.String("path", path), zap.Int("count", len(presets)))
+	return nil
+}
+
+// SetupTrustedProxies makes the Echo take the IP of the callers from the `X-Forwarded-For` header, but only when the
+// call comes from one of the given proxies. The header is ignored otherwise, the IP of the connection is used.
+func SetupTrustedProxies(e *echo.Echo, cidrs []string) error {
+	proxies, err := parseCIDRs(cidrs)
+	if err != nil {
+		return fmt.Errorf("invalid trusted proxy: %w", err)
+	}
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, p := range proxies {
+		options = append(options, echo.TrustIPRange(p))
+	}
+	e.IPExtractor = echo.ExtractIPFromXFFHeader(options...)
+	return nil
+}
+
+// inboundLimiter is the rate limit of each source IP of a Webhook
+type inboundLimiter struct {
+	mu        sync.Mutex
+	limit     rate.Limit
+	burst     int
+	visitors  map[string]*inboundVisitor
+	lastSweep time.Time
+}
+
+type inboundVisitor struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+var (
+	// inboundLimiters are by Webhook ID, they are created on the first call
+	inboundLimiters   = make(map[string]*inboundLimiter)
+	inboundLimitersMu = &sync.Mutex{}
+)
+
+// inboundLimiterFor returns the limiter of the Webhook, nil if it doesn't have any. A new limiter replaces the previous
+// one whenever the rate limit changes.
+func inboundLimiterFor(w *Webhook) *inboundLimiter {
+	if w.Access == nil || w.Access.RequestsPerSecond <= 0 {
+		return nil
+	}
+	limit := rate.Limit(w.Access.RequestsPerSecond)
+	burst := w.Access.Burst
+	if burst < 1 {
+		burst = int(math.Ceil(w.Access.RequestsPerSecond))
+	}
+
+	inboundLimitersMu.Lock()
+	defer inboundLimitersMu.Unlock()
+
+	if l, found := inboundLimiters[w.ID]; found && l.limit == limit && l.burst == burst {
+		return l
+	}
+	l := &inboundLimiter{limit: limit, burst: burst, visitors: make(map[string]*inboundVisitor)}
+	inboundLimiters[w.ID] = l
+	return l
+}
+
+// allow tells if the source IP can make a call at `now`
+func (l *inboundLimiter) allow(ip string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Forget the IPs that haven't called for a while, so that they don't pile up
+	if now.Sub(l.lastSweep) > inboundVisitorIdleTime {
+		for key, v := range l.visitors {
+			if now.Sub(v.lastSeen) > inboundVisitorIdleTime {
+				delete(l.visitors, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	v, found := l.visitors[ip]
+	if !found {
+		v = &inboundVisitor{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.visitors[ip] = v
+	}
+	v.lastSeen = now
+	return v.limiter.AllowN(now, 1)
+}
@@ -0,0 +1,119 @@
+package core
+
+import (
+	"net"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestAccessPolicyRefusal(t *testing.T) {
+	preset, err := parseCIDRs([]string{"192.0.2.0/28"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipPresetsMu.Lock()
+	previous := ipPresets
+	ipPresets = map[string][]*net.IPNet{"test": preset}
+	ipPresetsMu.Unlock()
+	defer func() {
+		ipPresetsMu.Lock()
+		ipPresets = previous
+		ipPresetsMu.Unlock()
+	}()
+
+	policy := &AccessPolicy{
+		Allow:        []string{"203.0.113.0/24", "2001:db8::/32"},
+		AllowPresets: []string{"test"},
+		Deny:         []string{"203.0.113.66"},
+	}
+	if err := policy.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	if err := SetupTrustedProxies(e, []string{"10.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		remoteAddr    string
+		forwardedFor  string
+		wantIP        string
+		wantRefusal   string
+		anyoneAllowed bool
+	}{
+		{name: "allowed", remoteAddr: "203.0.113.5:1234", wantIP: "203.0.113.5"},
+		{name: "allowed IPv6", remoteAddr: "[2001:db8::1]:1234", wantIP: "2001:db8::1"},
+		{name: "allowed by preset", remoteAddr: "192.0.2.10:1234", wantIP: "192.0.2.10"},
+		{name: "not allowed", remoteAddr: "198.51.100.7:1234", wantIP: "198.51.100.7", wantRefusal: "ip_not_allowed"},
+		{name: "denied although allowed", remoteAddr: "203.0.113.66:1234", wantIP: "203.0.113.66", wantRefusal: "ip_denied"},
+		// Behind a trusted proxy, the caller is the last IP it has added
+		{name: "through a trusted proxy", remoteAddr: "10.1.2.3:1234", forwardedFor: "203.0.113.5", wantIP: "203.0.113.5"},
+		{name: "through trusted proxies", remoteAddr: "10.1.2.3:1234", forwardedFor: "203.0.113.5, 10.9.9.9", wantIP: "203.0.113.5"},
+		{name: "spoofed through a trusted proxy", remoteAddr: "10.1.2.3:1234", forwardedFor: "203.0.113.5, 198.51.100.7",
+			wantIP: "198.51.100.7", wantRefusal: "ip_not_allowed"},
+		{name: "denied through a trusted proxy", remoteAddr: "10.1.2.3:1234", forwardedFor: "203.0.113.66",
+			wantIP: "203.0.113.66", wantRefusal: "ip_denied"},
+		// The header is ignored from anyone else, loopback included
+		{name: "spoofed by the caller", remoteAddr: "198.51.100.7:1234", forwardedFor: "203.0.113.5",
+			wantIP: "198.51.100.7", wantRefusal: "ip_not_allowed"},
+		{name: "spoofed from loopback", remoteAddr: "127.0.0.1:1234", forwardedFor: "203.0.113.5",
+			wantIP: "127.0.0.1", wantRefusal: "ip_not_allowed"},
+		{name: "anyone", remoteAddr: "198.51.100.7:1234", wantIP: "198.51.100.7", anyoneAllowed: true},
+		{name: "anyone but denied", remoteAddr: "203.0.113.66:1234", wantIP: "203.0.113.66", wantRefusal: "ip_denied",
+			anyoneAllowed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest("POST", "/hooks", nil)
+			request.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				request.Header.Set(echo.HeaderXForwardedFor, tt.forwardedFor)
+			}
+			ip := e.NewContext(request, httptest.NewRecorder()).RealIP()
+			if ip != tt.wantIP {
+				t.Fatalf("RealIP = %s, want %s", ip, tt.wantIP)
+			}
+
+			p := policy
+			if tt.anyoneAllowed {
+				p = &AccessPolicy{Deny: policy.Deny}
+				if err := p.Verify(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := p.refusal(net.ParseIP(ip)); got != tt.wantRefusal {
+				t.Errorf("refusal = %q, want %q", got, tt.wantRefusal)
+			}
+		})
+	}
+}
+
+func TestAccessPolicyVerifyInUse(t *testing.T) {
+	policy := &AccessPolicy{Allow: []string{"203.0.113.0/24"}}
+	if err := policy.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verified again while in use, as when its Webhook is registered again: -race would tell if it changed the policy
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := policy.Verify(); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if reason := policy.refusal(net.ParseIP("203.0.113.5")); reason != "" {
+				t.Error(reason)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,41 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Acknowledgement is the immediate response of a Webhook that doesn't wait on any of its Forward URLs: it is returned
+// as soon as the Requests are stored, they are then delivered in the background. It is not stored directly in the
+// database but as a child/nested object of the Webhook.
+type Acknowledgement struct {
+	// StatusCode of the response, 202 Accepted if not set
+	StatusCode int               `bson:"statusCode"  json:"statusCode"`
+	Headers    map[string]string `bson:"headers"     json:"headers"`
+	Body       string            `bson:"body"        json:"body"`
+}
+
+func (a *Acknowledgement) Verify() error {
+	if a.StatusCode != 0 && (a.StatusCode < 100 || a.StatusCode > 599) {
+		return fmt.Errorf("acknowledgement has an invalid status code: %d", a.StatusCode)
+	}
+	return nil
+}
+
+// respond writes the acknowledgement to the Webhook caller
+func (a *Acknowledgement) respond(c echo.Context) error {
+	status := a.StatusCode
+	if status == 0 {
+		status = http.StatusAccepted
+	}
+	for name, value := range a.Headers {
+		c.Response().Header().Set(name, value)
+	}
+	if a.Body == "" {
+		return c.NoContent(status)
+	}
+	// The Content-Type from the Headers, if any, is kept
+	return c.String(status, a.Body)
+}
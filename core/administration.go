@@ -1,31 +1,35 @@
 package core
 
 import (
+	"context"
 	"crypto/subtle"
 	"fmt"
-	"io"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/eliezedeck/gobase/logging"
-	"github.com/eliezedeck/gobase/random"
 	"github.com/eliezedeck/gobase/validation"
 	"github.com/eliezedeck/gobase/web"
 	"github.com/eliezedeck/webhook-ingestor/parameters"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 )
 
-func SetupAdministration(echoForWebhooks, echoForAdmin *echo.Echo, config ConfigStorage, reqStore RequestsStorage, path string) {
-	a := echoForAdmin.Group(path, middleware.BasicAuth(func(username, password string, c echo.Context) (bool, error) {
+func SetupAdministration(echoForAdmin *echo.Echo, config ConfigStorage, reqStore RequestsStorage, path string) {
+	auth := middleware.BasicAuth(func(username, password string, c echo.Context) (bool, error) {
 		if subtle.ConstantTimeCompare([]byte(username), []byte(parameters.ParamAdminUsername)) == 1 && subtle.ConstantTimeCompare([]byte(password), []byte(parameters.ParamAdminPassword)) == 1 {
 			return true, nil
 		}
 		return false, nil
-	}))
+	})
+	a := echoForAdmin.Group(path, auth)
+
+	// --- Prometheus metrics, under the admin path as the webhooks may be served by the same Echo
+	a.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
 
 	// ---
 	a.GET("/", func(c echo.Context) error {
@@ -44,7 +48,7 @@ func SetupAdministration(echoForWebhooks, echoForAdmin *echo.Echo, config Config
 	// --- Webhook: Add
 	a.POST("/webhooks", func(c echo.Context) error {
 		webhook := &Webhook{}
-		webhook.ID = fmt.Sprintf("w-%s", random.String(11))
+		webhook.ID = fmt.Sprintf("w-%s", RandomString(11))
 		webhook.Enabled = 1 // enabled by default
 		webhook.CreatedAt = time.Now()
 		if _, err := validation.ValidateJSONBody(c.Request().Body, webhook); err != nil {
@@ -52,27 +56,23 @@ func SetupAdministration(echoForWebhooks, echoForAdmin *echo.Echo, config Config
 		}
 
 		// Ensure that this Webhook doesn't already exist (using the Method and Path)
-		webhooks, err := config.GetAllWebhooks()
-		if err != nil {
+		if exists, err := webhookExists(config, webhook); err != nil {
 			return web.Error(c, err.Error())
-		}
-		for _, w := range webhooks {
-			if w.Method == webhook.Method && w.Path == webhook.Path {
-				return web.BadRequestError(c, "Webhook already exists")
-			}
+		} else if exists {
+			return web.BadRequestError(c, "Webhook already exists")
 		}
 		for _, furl := range webhook.ForwardUrls {
 			// Set IDs for each of the new forward URLs
-			furl.ID = fmt.Sprintf("f-%s", random.String(11))
+			furl.ID = fmt.Sprintf("f-%s", RandomString(11))
 		}
 
-		if err := config.AddWebhook(webhook); err != nil {
+		// Immediately register the route so that it's available for requests, this also verifies the Webhook
+		if err := RegisterWebhook(webhook); err != nil {
 			return web.BadRequestError(c, err.Error())
 		}
-
-		// Immediately register the route so that it's available for requests
-		if err := webhook.RegisterWithEcho(echoForWebhooks, reqStore); err != nil {
-			return web.Error(c, err.Error())
+		if err := config.AddWebhook(webhook); err != nil {
+			UnregisterWebhook(webhook.ID)
+			return web.BadRequestError(c, err.Error())
 		}
 
 		return c.JSON(http.StatusOK, webhook)
@@ -84,6 +84,8 @@ func SetupAdministration(echoForWebhooks, echoForAdmin *echo.Echo, config Config
 			return web.Error(c, err.Error())
 		}
 
+		// Calls to the Webhook are refused from now on
+		UnregisterWebhook(c.Param("id"))
 		return web.OK(c)
 	})
 
@@ -97,35 +99,50 @@ func SetupAdministration(echoForWebhooks, echoForAdmin *echo.Echo, config Config
 			return web.BadRequestError(c, "Webhook ID is required")
 		}
 
-		// - This doesn't re-register the handler, simply update the cache that is going to be used by the handler.
-		// - This also makes a verification to ensure that it remains a valid Webhook.
-		if err := webhook.RegisterWithEcho(echoForWebhooks, reqStore); err != nil {
+		// The Method and Path can change, as long as they don't collide with another Webhook
+		if err := checkWebhooks([]*Webhook{webhook}, nil); err != nil {
+			return web.BadRequestError(c, err.Error())
+		}
+		if exists, err := webhookExists(config, webhook); err != nil {
 			return web.Error(c, err.Error())
+		} else if exists {
+			return web.BadRequestError(c, "Another Webhook already exists with the same Method and Path")
 		}
 
+		previous, err := config.GetWebhook(webhook.ID)
+		if err != nil {
+			return web.Error(c, err.Error())
+		}
+		if previous == nil {
+			return web.BadRequestError(c, "Webhook not found")
+		}
 		if err := config.UpdateWebhook(webhook); err != nil {
 			return web.Error(c, err.Error())
 		}
+
+		// Route the calls to the updated version, it is unregistered if it has been disabled. The stored version is
+		// restored if it can't be.
+		updated, err := config.GetWebhook(webhook.ID)
+		if err == nil {
+			err = RegisterWebhook(updated)
+		}
+		if err != nil {
+			if restoreErr := config.UpdateWebhook(previous); restoreErr != nil {
+				logging.L.Error("Failed to restore the webhook", zap.String("id", webhook.ID), zap.Error(restoreErr))
+			}
+			return web.Error(c, err.Error())
+		}
 		return web.OK(c)
 	})
 
 	// --- Requests: List from newest
 	a.GET("/requests/newest", func(c echo.Context) error {
-		var err error
-
-		count := uint64(100)
-		countStr := strings.TrimSpace(c.QueryParam("count"))
-		if countStr != "" {
-			count, err = strconv.ParseUint(countStr, 10, 64)
-			if err != nil {
-				return web.BadRequestError(c, "Invalid count parameter")
-			}
-			if count > 1000 {
-				return web.BadRequestError(c, "Count parameter must be less than 1000")
-			}
+		count, err := countParam(c)
+		if err != nil {
+			return web.BadRequestError(c, err.Error())
 		}
 
-		requests, err := reqStore.GetNewestRequests(int(count))
+		requests, err := reqStore.GetNewestRequests(count)
 		if err != nil {
 			return web.Error(c, err.Error())
 		}
@@ -134,27 +151,32 @@ func SetupAdministration(echoForWebhooks, echoForAdmin *echo.Echo, config Config
 
 	// --- Requests: List from oldest
 	a.GET("/requests/oldest", func(c echo.Context) error {
-		var err error
-
-		count := uint64(100)
-		countStr := strings.TrimSpace(c.QueryParam("count"))
-		if countStr != "" {
-			count, err = strconv.ParseUint(countStr, 10, 64)
-			if err != nil {
-				return web.BadRequestError(c, "Invalid count parameter")
-			}
-			if count > 1000 {
-				return web.BadRequestError(c, "Count parameter must be less than 1000")
-			}
+		count, err := countParam(c)
+		if err != nil {
+			return web.BadRequestError(c, err.Error())
 		}
 
-		requests, err := reqStore.GetOldestRequests(int(count))
+		requests, err := reqStore.GetOldestRequests(count)
 		if err != nil {
 			return web.Error(c, err.Error())
 		}
 		return c.JSON(http.StatusOK, requests)
 	})
 
+	// --- Requests: List with filters, one page at a time
+	a.GET("/requests", func(c echo.Context) error {
+		query, err := requestQueryParams(c)
+		if err != nil {
+			return web.BadRequestError(c, err.Error())
+		}
+
+		page, err := queryRequests(reqStore, query)
+		if err != nil {
+			return web.Error(c, err.Error())
+		}
+		return c.JSON(http.StatusOK, page)
+	})
+
 	// --- Requests: Replay
 	a.POST("/requests/replay", func(c echo.Context) error {
 		// We only allow replay to a single Forward URL, pretty much any URL that's already registered
@@ -185,23 +207,19 @@ func SetupAdministration(echoForWebhooks, echoForAdmin *echo.Echo, config Config
 			return web.BadRequestError(c, "Invalid forward URL")
 		}
 
-		// Craft the request based on the saved Request instance
-		req, err := http.NewRequest(oreq.Method, furl.Url, strings.NewReader(oreq.Body))
+		// Forward a copy of the saved Request instance to the selected Forward URL, the attempt is recorded
+		freq := *oreq
+		freq.setForwardUrl(furl)
+		ctx, cancel := context.WithTimeout(c.Request().Context(), time.Duration(furl.Timeout))
+		defer cancel()
+		response, fbody, err := forwardRequest(ctx, reqStore, &freq)
 		if err != nil {
 			return web.Error(c, err.Error())
 		}
-		TransferHeaders(req.Header, oreq.Headers)
-
-		// Execute the request
-		response, err := ForwardHttpClient.Do(req)
-		if err != nil {
-			return web.Error(c, err.Error())
-		}
-		defer response.Body.Close()
 
 		TransferHeaders(c.Response().Header(), response.Header)
 		c.Response().WriteHeader(response.StatusCode)
-		if _, err = io.Copy(c.Response(), response.Body); err != nil {
+		if _, err = c.Response().Write(fbody); err != nil {
 			return web.Error(c, err.Error())
 		}
 
@@ -210,18 +228,331 @@ func SetupAdministration(echoForWebhooks, echoForAdmin *echo.Echo, config Config
 			if err = reqStore.DeleteRequest(wreq.RequestId); err != nil {
 				return web.Error(c, err.Error())
 			}
+			if err = reqStore.DeleteDeliveryAttempts(wreq.RequestId); err != nil {
+				return web.Error(c, err.Error())
+			}
+			deleteBlob(wreq.RequestId)
 		}
 
 		return nil // success
 	})
 
+	// --- Transform: Preview what would be forwarded, nothing is sent
+	a.POST("/transform/preview", func(c echo.Context) error {
+		preview := TransformPreview{}
+		if _, err := validation.ValidateJSONBody(c.Request().Body, &preview); err != nil {
+			return web.BadRequestError(c, "Invalid JSON body")
+		}
+
+		request := preview.Request
+		if preview.RequestId != "" {
+			var err error
+			if request, err = reqStore.GetRequest(preview.RequestId); err != nil {
+				return web.Error(c, err.Error())
+			}
+			if request == nil {
+				if request, err = reqStore.GetDeadLetter(preview.RequestId); err != nil {
+					return web.Error(c, err.Error())
+				}
+			}
+		}
+		if request == nil {
+			return web.BadRequestError(c, "Invalid request")
+		}
+
+		transform, url := preview.Transform, preview.Url
+		if preview.WebhookId != "" {
+			webhook, err := config.GetWebhook(preview.WebhookId)
+			if err != nil {
+				return web.Error(c, err.Error())
+			}
+			if webhook == nil {
+				return web.BadRequestError(c, "Invalid webhook")
+			}
+			var furl *ForwardUrl
+			for _, f := range webhook.ForwardUrls {
+				if f.ID == preview.ForwardUrlId {
+					furl = f
+				}
+			}
+			if furl == nil {
+				return web.BadRequestError(c, "Invalid forward URL")
+			}
+			transform, url = furl.Transform, furl.Url
+		}
+		if transform != nil {
+			// The Transform of a Forward URL may be in use, only its copy is looked into
+			clone := *transform
+			transform = &clone
+			if err := transform.Verify(); err != nil {
+				return web.BadRequestError(c, err.Error())
+			}
+		}
+
+		transformed, err := transform.Apply(request, url)
+		if err != nil {
+			return web.BadRequestError(c, err.Error())
+		}
+		return c.JSON(http.StatusOK, transformed)
+	})
+
+	// --- Requests: Delivery attempts, also works for the dead letters
+	a.GET("/requests/:id/attempts", func(c echo.Context) error {
+		attempts, err := reqStore.GetDeliveryAttempts(c.Param("id"))
+		if err != nil {
+			return web.Error(c, err.Error())
+		}
+		return c.JSON(http.StatusOK, attempts)
+	})
+
+	// --- Requests: Body, spooled or not, also works for the dead letters
+	a.GET("/requests/:id/body", func(c echo.Context) error {
+		request, err := reqStore.GetRequest(c.Param("id"))
+		if err == nil && request == nil {
+			request, err = reqStore.GetDeadLetter(c.Param("id"))
+		}
+		if err != nil {
+			return web.Error(c, err.Error())
+		}
+		if request == nil {
+			return c.JSON(http.StatusNotFound, map[string]interface{}{
+				"error": "Request not found",
+			})
+		}
+		if request.BodyBlob == "" {
+			return c.Blob(http.StatusOK, echo.MIMEOctetStream, request.Body)
+		}
+		blob, err := openBlob(request.BodyBlob)
+		if err != nil {
+			return web.Error(c, err.Error())
+		}
+		defer func() {
+			_ = blob.Close()
+		}()
+		c.Response().Header().Set(echo.HeaderContentLength, strconv.FormatInt(request.BodySize, 10))
+		return c.Stream(http.StatusOK, echo.MIMEOctetStream, blob)
+	})
+
 	// --- Requests: Delete by ID
 	a.DELETE("/requests/:id", func(c echo.Context) error {
 		if err := reqStore.DeleteRequest(c.Param("id")); err != nil {
 			return web.Error(c, err.Error())
 		}
+		if err := reqStore.DeleteDeliveryAttempts(c.Param("id")); err != nil {
+			return web.Error(c, err.Error())
+		}
+		deleteBlob(c.Param("id"))
 		return web.OK(c)
 	})
 
+	// --- Dead letters: List from newest
+	a.GET("/deadletters", func(c echo.Context) error {
+		count, err := countParam(c)
+		if err != nil {
+			return web.BadRequestError(c, err.Error())
+		}
+
+		requests, err := reqStore.GetDeadLetters(deadLetterFilterParams(c), count)
+		if err != nil {
+			return web.Error(c, err.Error())
+		}
+		return c.JSON(http.StatusOK, requests)
+	})
+
+	// --- Dead letters: Get by ID
+	a.GET("/deadletters/:id", func(c echo.Context) error {
+		request, err := reqStore.GetDeadLetter(c.Param("id"))
+		if err != nil {
+			return web.Error(c, err.Error())
+		}
+		if request == nil {
+			return c.JSON(http.StatusNotFound, map[string]interface{}{
+				"error": "Dead letter not found",
+			})
+		}
+		return c.JSON(http.StatusOK, request)
+	})
+
+	// --- Dead letters: Replay in bulk, they are requeued for the delivery workers
+	a.POST("/deadletters/replay", func(c echo.Context) error {
+		dreplay := DeadLetterReplay{}
+		if _, err := validation.ValidateJSONBody(c.Request().Body, &dreplay); err != nil {
+			return web.BadRequestError(c, "Invalid JSON body")
+		}
+
+		var requests []*Request
+		if len(dreplay.Ids) > 0 {
+			for _, id := range dreplay.Ids {
+				request, err := reqStore.GetDeadLetter(id)
+				if err != nil {
+					return web.Error(c, err.Error())
+				}
+				if request == nil {
+					return web.BadRequestError(c, fmt.Sprintf("Dead letter %s not found", id))
+				}
+				requests = append(requests, request)
+			}
+		} else {
+			var err error
+			requests, err = reqStore.GetDeadLetters(DeadLetterFilter{
+				WebhookId:    dreplay.WebhookId,
+				ForwardUrlId: dreplay.ForwardUrlId,
+			}, 1000)
+			if err != nil {
+				return web.Error(c, err.Error())
+			}
+		}
+
+		requeued := 0
+		for _, request := range requests {
+			if err := requeueDeadLetter(config, reqStore, request); err != nil {
+				return web.Error(c, err.Error())
+			}
+			requeued++
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"requeued": requeued,
+		})
+	})
+
+	// --- Dead letters: Delete by ID
+	a.DELETE("/deadletters/:id", func(c echo.Context) error {
+		if err := reqStore.DeleteDeadLetter(c.Param("id")); err != nil {
+			return web.Error(c, err.Error())
+		}
+		if err := reqStore.DeleteDeliveryAttempts(c.Param("id")); err != nil {
+			return web.Error(c, err.Error())
+		}
+		deleteBlob(c.Param("id"))
+		return web.OK(c)
+	})
+
+	// --- Dead letters: Purge
+	a.DELETE("/deadletters", func(c echo.Context) error {
+		purged, err := reqStore.PurgeDeadLetters(deadLetterFilterParams(c))
+		if err != nil {
+			return web.Error(c, err.Error())
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"purged": purged,
+		})
+	})
+
+	// --- Circuit breakers: List, for the Forward URLs that have already been forwarded to
+	a.GET("/circuitbreakers", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, GetCircuitBreakers())
+	})
+
+	// --- Circuit breakers: Close by hand
+	a.POST("/circuitbreakers/:webhookId/:forwardUrlId/reset", func(c echo.Context) error {
+		if !ResetCircuitBreaker(c.Param("webhookId"), c.Param("forwardUrlId")) {
+			return c.JSON(http.StatusNotFound, map[string]interface{}{
+				"error": "Circuit breaker not found",
+			})
+		}
+		return web.OK(c)
+	})
+
+	// --- Retention: Latest reports of what has been purged
+	a.GET("/retention/reports", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, getRetentionReports())
+	})
+
+	// --- Retention: Run now
+	a.POST("/retention/run", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, runRetention(config, reqStore))
+	})
+
 	logging.L.Info("Administration setup complete", zap.String("path", path))
 }
+
+// webhookExists tells if another Webhook, with a different ID, already receives the calls with the same Method and
+// Path, enabled or not
+func webhookExists(config ConfigStorage, webhook *Webhook) (bool, error) {
+	webhooks, err := config.GetAllWebhooks()
+	if err != nil {
+		return false, err
+	}
+	for _, w := range webhooks {
+		if webhook.collidesWith(w) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// countParam returns the `count` query parameter, defaults to 100 and is capped at 1000
+func countParam(c echo.Context) (int, error) {
+	countStr := strings.TrimSpace(c.QueryParam("count"))
+	if countStr == "" {
+		return 100, nil
+	}
+	count, err := strconv.ParseUint(countStr, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid count parameter")
+	}
+	if count > 1000 {
+		return 0, fmt.Errorf("Count parameter must be less than 1000")
+	}
+	return int(count), nil
+}
+
+// requestQueryParams builds the RequestQuery from the query parameters: webhookId, forwardUrlId, method, pathPrefix,
+// since & until (RFC 3339), header (as Name:Value), status, order (newest or oldest), count and cursor.
+func requestQueryParams(c echo.Context) (*RequestQuery, error) {
+	count, err := countParam(c)
+	if err != nil {
+		return nil, err
+	}
+	query := &RequestQuery{
+		WebhookId:    strings.TrimSpace(c.QueryParam("webhookId")),
+		ForwardUrlId: strings.TrimSpace(c.QueryParam("forwardUrlId")),
+		Method:       strings.ToUpper(strings.TrimSpace(c.QueryParam("method"))),
+		PathPrefix:   c.QueryParam("pathPrefix"),
+		Status:       strings.TrimSpace(c.QueryParam("status")),
+		NewestFirst:  true,
+		Limit:        count,
+	}
+
+	switch c.QueryParam("order") {
+	case "", "newest":
+	case "oldest":
+		query.NewestFirst = false
+	default:
+		return nil, fmt.Errorf("Invalid order parameter, must be 'newest' or 'oldest'")
+	}
+
+	for name, dest := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if value := strings.TrimSpace(c.QueryParam(name)); value != "" {
+			if *dest, err = time.Parse(time.RFC3339Nano, value); err != nil {
+				return nil, fmt.Errorf("Invalid %s parameter, must be RFC 3339", name)
+			}
+		}
+	}
+
+	if header := c.QueryParam("header"); header != "" {
+		kv := strings.SplitN(header, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("Invalid header parameter, must be Name:Value")
+		}
+		query.Header = strings.TrimSpace(kv[0])
+		query.HeaderValue = strings.TrimSpace(kv[1])
+	}
+
+	if cursor := strings.TrimSpace(c.QueryParam("cursor")); cursor != "" {
+		if query.After, err = DecodeRequestCursor(cursor); err != nil {
+			return nil, err
+		}
+		if query.After.NewestFirst != query.NewestFirst {
+			return nil, fmt.Errorf("Cursor was made for a different order")
+		}
+	}
+	return query, nil
+}
+
+func deadLetterFilterParams(c echo.Context) DeadLetterFilter {
+	return DeadLetterFilter{
+		WebhookId:    strings.TrimSpace(c.QueryParam("webhookId")),
+		ForwardUrlId: strings.TrimSpace(c.QueryParam("forwardUrlId")),
+	}
+}
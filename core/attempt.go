@@ -0,0 +1,79 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/eliezedeck/gobase/logging"
+	"go.uber.org/zap"
+)
+
+// deliveryAttemptBodyLimit is how much of the forwarded host's response body is kept on a DeliveryAttempt
+const deliveryAttemptBodyLimit = 4 << 10
+
+// DeliveryAttempt is the full record of a single forward of a Request: what the forwarded host has answered, or why it
+// could not be reached. Unlike the Attempt, it is stored on its own, linked to the Request by its ID.
+type DeliveryAttempt struct {
+	ID           string    `bson:"_id"           json:"id"`
+	RequestId    string    `bson:"requestId"     json:"requestId"`
+	WebhookId    string    `bson:"webhookId"     json:"webhookId"`
+	ForwardUrlId string    `bson:"forwardUrlId"  json:"forwardUrlId"`
+	Url          string    `bson:"url"           json:"url"`
+	Number       int       `bson:"number"        json:"number"`
+	StartedAt    time.Time `bson:"startedAt"     json:"startedAt"`
+	// Latency is the time until the response has been fully read, or until the forward has failed
+	Latency time.Duration `bson:"latency"  json:"latency"`
+
+	StatusCode      int                 `bson:"statusCode"       json:"statusCode"`
+	ResponseHeaders map[string][]string `bson:"responseHeaders"  json:"responseHeaders"`
+	// ResponseBody is truncated to the first few KiB, it is given in JSON as text or base64 like the Request's Body
+	ResponseBody          []byte `bson:"responseBody"           json:"-"`
+	ResponseBodyTruncated bool   `bson:"responseBodyTruncated"  json:"responseBodyTruncated"`
+	Error                 string `bson:"error"                  json:"error"`
+
+	// ExpiresAt is when the DeliveryAttempt is to be purged, never if zero
+	ExpiresAt time.Time `bson:"expiresAt,omitempty" json:"expiresAt"`
+}
+
+func newDeliveryAttempt(request *Request, attempt *Attempt) *DeliveryAttempt {
+	furl := request.forwardUrl()
+	return &DeliveryAttempt{
+		ID:           fmt.Sprintf("a-%s", RandomString(16)),
+		RequestId:    request.ID,
+		WebhookId:    request.FromWebhookId,
+		ForwardUrlId: furl.ID,
+		Url:          furl.Url,
+		Number:       len(request.Attempts),
+		StartedAt:    attempt.At,
+		ExpiresAt:    retentionFor(request.FromWebhookId).attemptExpiresAt(attempt.At),
+	}
+}
+
+// setResponse records the response of the forwarded host, along with the beginning of its body
+func (a *DeliveryAttempt) setResponse(response *http.Response, body []byte) {
+	a.StatusCode = response.StatusCode
+	a.ResponseHeaders = response.Header
+	if len(body) > deliveryAttemptBodyLimit {
+		text := utf8.Valid(body)
+		body = body[:deliveryAttemptBodyLimit]
+		for text && !utf8.Valid(body) {
+			// Cut before the split character, so that the text is still given as text
+			body = body[:len(body)-1]
+		}
+		a.ResponseBodyTruncated = true
+	}
+	a.ResponseBody = append([]byte(nil), body...)
+}
+
+// storeDeliveryAttempt never fails the delivery itself, the DeliveryAttempt is only informational
+func storeDeliveryAttempt(storage RequestsStorage, attempt *DeliveryAttempt) {
+	attempt.Latency = time.Since(attempt.StartedAt)
+	observeForward(attempt)
+	if err := storage.StoreDeliveryAttempt(attempt); err != nil {
+		logging.L.Error("Error saving delivery attempt", zap.Error(err),
+			zap.String("requestId", attempt.RequestId),
+			zap.String("attemptId", attempt.ID))
+	}
+}
@@ -0,0 +1,150 @@
+package core
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+// BodyEncodingBase64 is the `bodyEncoding` of the bodies that are not valid UTF-8 in the JSON of the administration,
+// they are base64 encoded. The others are given as is, without any `bodyEncoding`.
+const BodyEncodingBase64 = "base64"
+
+// encodeBody returns the body as it is given in JSON, along with its `bodyEncoding`
+func encodeBody(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), BodyEncodingBase64
+}
+
+func decodeBody(body, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return []byte(body), nil
+	case BodyEncodingBase64:
+		return base64.StdEncoding.DecodeString(body)
+	}
+	return nil, fmt.Errorf("unsupported body encoding: %s", encoding)
+}
+
+// bodyField logs the body as text, or as base64 if it is not valid UTF-8
+func bodyField(body []byte) zap.Field {
+	if utf8.Valid(body) {
+		return zap.ByteString("body", body)
+	}
+	return zap.Binary("body", body)
+}
+
+// MarshalJSON gives the Body as text if it is valid UTF-8, base64 encoded otherwise. The secrets of the ForwardUrl are
+// never given, even those of the Requests stored before they were left out.
+func (r Request) MarshalJSON() ([]byte, error) {
+	type plain Request
+	if r.ForwardUrl != nil {
+		r.ForwardUrl = r.ForwardUrl.withoutSecrets()
+	}
+	body, encoding := encodeBody(r.Body)
+	return json.Marshal(&struct {
+		plain
+		Body         string `json:"body"`
+		BodyEncoding string `json:"bodyEncoding,omitempty"`
+	}{plain(r), body, encoding})
+}
+
+func (r *Request) UnmarshalJSON(data []byte) error {
+	type plain Request
+	decoded := &struct {
+		*plain
+		Body         string `json:"body"`
+		BodyEncoding string `json:"bodyEncoding"`
+	}{plain: (*plain)(r)}
+	if err := json.Unmarshal(data, decoded); err != nil {
+		return err
+	}
+	body, err := decodeBody(decoded.Body, decoded.BodyEncoding)
+	if err != nil {
+		return err
+	}
+	r.Body = body
+	return nil
+}
+
+// MarshalJSON gives the Body as text if it is valid UTF-8, base64 encoded otherwise
+func (t TransformedRequest) MarshalJSON() ([]byte, error) {
+	type plain TransformedRequest
+	body, encoding := encodeBody(t.Body)
+	return json.Marshal(&struct {
+		plain
+		Body         string `json:"body"`
+		BodyEncoding string `json:"bodyEncoding,omitempty"`
+	}{plain(t), body, encoding})
+}
+
+// MarshalJSON gives the ResponseBody as text if it is valid UTF-8, base64 encoded otherwise
+func (a DeliveryAttempt) MarshalJSON() ([]byte, error) {
+	type plain DeliveryAttempt
+	body, encoding := encodeBody(a.ResponseBody)
+	return json.Marshal(&struct {
+		plain
+		ResponseBody         string `json:"responseBody"`
+		ResponseBodyEncoding string `json:"responseBodyEncoding,omitempty"`
+	}{plain(a), body, encoding})
+}
+
+// contentCoding returns the Content-Encoding of the call, empty if there is none
+func contentCoding(header http.Header) string {
+	coding := strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding")))
+	if coding == "identity" {
+		return ""
+	}
+	return coding
+}
+
+// decompress returns the body without its content coding, gzip and deflate are supported. ErrBodyTooLarge is returned
+// if the decompressed body exceeds the `limit`, 0 being unlimited.
+func decompress(body []byte, coding string, limit int64) ([]byte, error) {
+	var reader io.Reader
+	switch coding {
+	case "":
+		return body, nil
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		reader = gz
+	case "deflate":
+		// Supposed to be zlib, but some send raw deflate
+		zr, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			reader = flate.NewReader(bytes.NewReader(body))
+		} else {
+			reader = zr
+		}
+	default:
+		return nil, fmt.Errorf("unsupported content encoding: %s", coding)
+	}
+	return io.ReadAll(&limitedBody{body: reader, limit: limit})
+}
+
+// content returns the Body as it is looked into, decompressed if it can be within the max body size of its Webhook
+func (r *Request) content() []byte {
+	if r.ContentEncoding == "" {
+		return r.Body
+	}
+	content, err := decompress(r.Body, r.ContentEncoding, maxBodySizeFor(r.FromWebhookId))
+	if err != nil {
+		return r.Body
+	}
+	return content
+}
@@ -0,0 +1,92 @@
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRequestContent(t *testing.T) {
+	original := strings.Repeat("a", 2048)
+	compressed := &bytes.Buffer{}
+	gz := gzip.NewWriter(compressed)
+	_, _ = gz.Write([]byte(original))
+	_ = gz.Close()
+
+	routesMu.Lock()
+	routedWebhooks["w-small"] = &Webhook{ID: "w-small", MaxBodySize: 1024}
+	routedWebhooks["w-large"] = &Webhook{ID: "w-large", MaxBodySize: 4096}
+	routesMu.Unlock()
+	defer func() {
+		routesMu.Lock()
+		delete(routedWebhooks, "w-small")
+		delete(routedWebhooks, "w-large")
+		routesMu.Unlock()
+	}()
+	defer func(size int64) { MaxBodySize = size }(MaxBodySize)
+	MaxBodySize = 1024
+
+	tests := []struct {
+		webhookId string
+		want      string
+	}{
+		// Beyond the limit, the body is looked into as it is
+		{"w-small", compressed.String()},
+		// The Webhook's own limit wins over the global one
+		{"w-large", original},
+		{"w-unknown", compressed.String()},
+	}
+	for _, tt := range tests {
+		request := &Request{FromWebhookId: tt.webhookId, Body: compressed.Bytes(), ContentEncoding: "gzip"}
+		if got := string(request.content()); got != tt.want {
+			t.Errorf("%s: content has %d bytes, want %d", tt.webhookId, len(got), len(tt.want))
+		}
+	}
+}
+
+func TestDeliveryAttemptResponseBody(t *testing.T) {
+	// "é" is 2 bytes long, the limit falls right in the middle of the last one
+	text := strings.Repeat("a", deliveryAttemptBodyLimit-1) + "éé"
+	binary := append([]byte{0x89, 'P', 'N', 'G', 0xff}, make([]byte, 16)...)
+
+	tests := []struct {
+		name      string
+		body      []byte
+		wantBody  string
+		encoding  string
+		truncated bool
+	}{
+		{"text", []byte(`{"ok":true}`), `{"ok":true}`, "", false},
+		{"binary", binary, base64.StdEncoding.EncodeToString(binary), BodyEncodingBase64, false},
+		{"text cut before the split character", []byte(text), strings.Repeat("a", deliveryAttemptBodyLimit-1), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempt := &DeliveryAttempt{}
+			attempt.setResponse(&http.Response{StatusCode: http.StatusOK}, tt.body)
+			if attempt.ResponseBodyTruncated != tt.truncated {
+				t.Errorf("ResponseBodyTruncated = %v, want %v", attempt.ResponseBodyTruncated, tt.truncated)
+			}
+
+			encoded, err := json.Marshal(attempt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got struct {
+				ResponseBody         string `json:"responseBody"`
+				ResponseBodyEncoding string `json:"responseBodyEncoding"`
+			}
+			if err := json.Unmarshal(encoded, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.ResponseBody != tt.wantBody || got.ResponseBodyEncoding != tt.encoding {
+				t.Errorf("JSON has a body of %d bytes encoded as %q, want %d bytes encoded as %q",
+					len(got.ResponseBody), got.ResponseBodyEncoding, len(tt.wantBody), tt.encoding)
+			}
+		})
+	}
+}
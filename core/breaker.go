@@ -0,0 +1,220 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	CircuitStateClosed   = "closed"
+	CircuitStateOpen     = "open"
+	CircuitStateHalfOpen = "half-open"
+
+	defaultCircuitFailureThreshold = 5
+	defaultCircuitCoolDown         = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned instead of forwarding while the CircuitBreaker of the ForwardUrl is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitBreakerPolicy stops forwarding to a ForwardUrl that keeps failing, so that the calls to the Webhook don't all
+// wait for its Timeout. Meanwhile, the Requests are kept pending and delivered once it has recovered. It is not stored
+// directly in the database but as a child/nested object of the ForwardUrl.
+//
+// The state of the breakers is kept by each instance, in memory.
+type CircuitBreakerPolicy struct {
+	// FailureThreshold is the number of consecutive failed forwards that opens the breaker, defaults to 5
+	FailureThreshold int `bson:"failureThreshold"  json:"failureThreshold"`
+	// CoolDown is how long the breaker stays open, before a single forward is let through to probe the ForwardUrl;
+	// defaults to 30 seconds
+	CoolDown Duration `bson:"coolDown"  json:"coolDown"`
+	// SuccessThreshold is the number of successful probes that closes the breaker again, defaults to 1
+	SuccessThreshold int `bson:"successThreshold"  json:"successThreshold"`
+}
+
+func (p *CircuitBreakerPolicy) Verify() error {
+	if p.FailureThreshold < 0 || p.SuccessThreshold < 0 {
+		return fmt.Errorf("circuit breaker thresholds must not be negative")
+	}
+	if p.CoolDown < 0 {
+		return fmt.Errorf("circuit breaker cool down must not be negative")
+	}
+	return nil
+}
+
+func (p *CircuitBreakerPolicy) failureThreshold() int {
+	if p.FailureThreshold < 1 {
+		return defaultCircuitFailureThreshold
+	}
+	return p.FailureThreshold
+}
+
+func (p *CircuitBreakerPolicy) coolDown() time.Duration {
+	if p.CoolDown <= 0 {
+		return defaultCircuitCoolDown
+	}
+	return time.Duration(p.CoolDown)
+}
+
+func (p *CircuitBreakerPolicy) successThreshold() int {
+	if p.SuccessThreshold < 1 {
+		return 1
+	}
+	return p.SuccessThreshold
+}
+
+// CircuitBreakerState is the current state of the breaker of a ForwardUrl
+type CircuitBreakerState struct {
+	WebhookId    string `json:"webhookId"`
+	ForwardUrlId string `json:"forwardUrlId"`
+	State        string `json:"state"`
+	// Failures is the number of consecutive failed forwards, Successes the number of successful probes while half-open
+	Failures  int `json:"failures"`
+	Successes int `json:"successes"`
+	// OpenedAt is when the breaker has last been opened, zero if it never has
+	OpenedAt time.Time `json:"openedAt"`
+}
+
+type circuitBreaker struct {
+	mu     sync.Mutex
+	policy *CircuitBreakerPolicy
+	state  CircuitBreakerState
+	// probing is set while the single forward of the half-open state is in flight
+	probing bool
+}
+
+var (
+	// circuitBreakers are by Webhook ID and ForwardUrl ID, they are created on the first forward
+	circuitBreakers   = make(map[string]*circuitBreaker)
+	circuitBreakersMu = &sync.Mutex{}
+)
+
+func circuitBreakerKey(webhookId, forwardUrlId string) string {
+	return webhookId + "/" + forwardUrlId
+}
+
+// circuitBreakerFor returns the breaker of the ForwardUrl, nil if it doesn't have any
+func circuitBreakerFor(webhookId string, furl *ForwardUrl) *circuitBreaker {
+	if furl.CircuitBreaker == nil {
+		return nil
+	}
+
+	circuitBreakersMu.Lock()
+	defer circuitBreakersMu.Unlock()
+
+	key := circuitBreakerKey(webhookId, furl.ID)
+	b, found := circuitBreakers[key]
+	if !found {
+		b = &circuitBreaker{state: CircuitBreakerState{
+			WebhookId:    webhookId,
+			ForwardUrlId: furl.ID,
+			State:        CircuitStateClosed,
+		}}
+		circuitBreakers[key] = b
+		observeCircuitBreaker(&b.state)
+	}
+	b.mu.Lock()
+	b.policy = furl.CircuitBreaker // it may have been changed since
+	b.mu.Unlock()
+	return b
+}
+
+// allow tells if a forward can be made at `now`. If it can't, it also returns when the breaker lets a forward through
+// again.
+func (b *circuitBreaker) allow(now time.Time) (bool, time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state.State {
+	case CircuitStateOpen:
+		reopenAt := b.state.OpenedAt.Add(b.policy.coolDown())
+		if now.Before(reopenAt) {
+			return false, reopenAt
+		}
+		b.setState(CircuitStateHalfOpen)
+		b.probing = true
+		return true, time.Time{}
+	case CircuitStateHalfOpen:
+		if b.probing {
+			return false, now.Add(b.policy.coolDown())
+		}
+		b.probing = true
+		return true, time.Time{}
+	}
+	return true, time.Time{}
+}
+
+// record takes the outcome of a forward into account
+func (b *circuitBreaker) record(success bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if success {
+		b.state.Failures = 0
+		if b.state.State == CircuitStateHalfOpen {
+			b.state.Successes++
+			if b.state.Successes >= b.policy.successThreshold() {
+				b.setState(CircuitStateClosed)
+			}
+		}
+		return
+	}
+
+	b.state.Failures++
+	if b.state.State == CircuitStateHalfOpen || b.state.Failures >= b.policy.failureThreshold() {
+		b.state.OpenedAt = now
+		b.setState(CircuitStateOpen)
+	}
+}
+
+// setState must be called with the mu locked
+func (b *circuitBreaker) setState(state string) {
+	b.state.State = state
+	b.state.Successes = 0
+	observeCircuitBreaker(&b.state)
+}
+
+// GetCircuitBreakers returns the state of the breakers of the registered Webhooks
+func GetCircuitBreakers() []*CircuitBreakerState {
+	circuitBreakersMu.Lock()
+	defer circuitBreakersMu.Unlock()
+
+	states := make([]*CircuitBreakerState, 0, len(circuitBreakers))
+	for _, b := range circuitBreakers {
+		if registeredWebhook(b.state.WebhookId) == nil {
+			continue
+		}
+		b.mu.Lock()
+		state := b.state
+		b.mu.Unlock()
+		states = append(states, &state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return circuitBreakerKey(states[i].WebhookId, states[i].ForwardUrlId) <
+			circuitBreakerKey(states[j].WebhookId, states[j].ForwardUrlId)
+	})
+	return states
+}
+
+// ResetCircuitBreaker closes the breaker of the ForwardUrl by hand, it returns false if there is no such breaker. The
+// Requests that were held back are delivered on their next attempt.
+func ResetCircuitBreaker(webhookId, forwardUrlId string) bool {
+	circuitBreakersMu.Lock()
+	b, found := circuitBreakers[circuitBreakerKey(webhookId, forwardUrlId)]
+	circuitBreakersMu.Unlock()
+	if !found {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	b.state.Failures = 0
+	b.setState(CircuitStateClosed)
+	return true
+}
@@ -0,0 +1,93 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	type step struct {
+		// do is either allow, success, failure or reset
+		do string
+		at time.Duration
+		// allowed is only checked on allow
+		allowed bool
+		state   string
+	}
+	failTwice := []step{
+		{do: "failure", state: CircuitStateClosed},
+		{do: "failure", state: CircuitStateOpen},
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"opens after the failure threshold", append(failTwice,
+			step{do: "allow", at: 30 * time.Second, allowed: false, state: CircuitStateOpen},
+		)},
+		{"a success resets the failures", []step{
+			{do: "failure", state: CircuitStateClosed},
+			{do: "success", state: CircuitStateClosed},
+			{do: "failure", state: CircuitStateClosed},
+			{do: "allow", allowed: true, state: CircuitStateClosed},
+		}},
+		{"half-open lets a single probe through", append(failTwice,
+			step{do: "allow", at: time.Minute, allowed: true, state: CircuitStateHalfOpen},
+			step{do: "allow", at: time.Minute, allowed: false, state: CircuitStateHalfOpen},
+			step{do: "success", at: time.Minute, state: CircuitStateHalfOpen},
+			step{do: "allow", at: time.Minute, allowed: true, state: CircuitStateHalfOpen},
+			step{do: "success", at: time.Minute, state: CircuitStateClosed},
+			step{do: "allow", at: time.Minute, allowed: true, state: CircuitStateClosed},
+		)},
+		{"failed probe opens again", append(failTwice,
+			step{do: "allow", at: time.Minute, allowed: true, state: CircuitStateHalfOpen},
+			step{do: "failure", at: time.Minute, state: CircuitStateOpen},
+			step{do: "allow", at: 90 * time.Second, allowed: false, state: CircuitStateOpen},
+			step{do: "allow", at: 2 * time.Minute, allowed: true, state: CircuitStateHalfOpen},
+		)},
+		{"reset closes it by hand", append(failTwice,
+			step{do: "reset", state: CircuitStateClosed},
+			step{do: "allow", allowed: true, state: CircuitStateClosed},
+			step{do: "failure", state: CircuitStateClosed},
+		)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			furl := &ForwardUrl{
+				ID:             "f-1",
+				CircuitBreaker: &CircuitBreakerPolicy{FailureThreshold: 2, CoolDown: Duration(time.Minute), SuccessThreshold: 2},
+			}
+			b := circuitBreakerFor("w-breaker", furl)
+			defer func() {
+				circuitBreakersMu.Lock()
+				delete(circuitBreakers, circuitBreakerKey("w-breaker", furl.ID))
+				circuitBreakersMu.Unlock()
+			}()
+
+			start := time.Now()
+			for i, s := range tt.steps {
+				now := start.Add(s.at)
+				switch s.do {
+				case "allow":
+					allowed, retryAt := b.allow(now)
+					if allowed != s.allowed {
+						t.Fatalf("step %d: allow = %v, want %v", i+1, allowed, s.allowed)
+					}
+					if !allowed && !retryAt.After(now) {
+						t.Errorf("step %d: held back until %s, which is not later", i+1, retryAt)
+					}
+				case "success", "failure":
+					b.record(s.do == "success", now)
+				case "reset":
+					if !ResetCircuitBreaker("w-breaker", furl.ID) {
+						t.Fatalf("step %d: breaker not found", i+1)
+					}
+				}
+				if b.state.State != s.state {
+					t.Fatalf("step %d (%s): state = %s, want %s", i+1, s.do, b.state.State, s.state)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package core
+
+import "time"
+
+// DeadLetterFilter selects the dead letters by their origin. Empty fields match everything.
+type DeadLetterFilter struct {
+	WebhookId    string
+	ForwardUrlId string
+}
+
+func (f DeadLetterFilter) Matches(request *Request) bool {
+	if f.WebhookId != "" && request.FromWebhookId != f.WebhookId {
+		return false
+	}
+	if f.ForwardUrlId != "" && (request.ForwardUrl == nil || request.ForwardUrl.ID != f.ForwardUrlId) {
+		return false
+	}
+	return true
+}
+
+// DeadLetterReplay is the set of information required to replay dead letters in bulk: either the given IDs, or all the
+// dead letters matching the WebhookId and ForwardUrlId.
+type DeadLetterReplay struct {
+	Ids          []string `json:"ids"`
+	WebhookId    string   `json:"webhookId"`
+	ForwardUrlId string   `json:"forwardUrlId"`
+}
+
+// requeueDeadLetter moves the dead letter back as a pending Request, so that the delivery workers retry it from
+// scratch. The ForwardUrl is refreshed from the Webhook, if it still exists.
+func requeueDeadLetter(config ConfigStorage, reqStore RequestsStorage, request *Request) error {
+	if request.ForwardUrl == nil {
+		return nil
+	}
+
+	furl, err := currentForwardUrl(config, request.FromWebhookId, request.ForwardUrl.ID)
+	if err != nil {
+		return err
+	}
+	if furl != nil {
+		request.setForwardUrl(furl)
+	}
+
+	request.Status = RequestStatusPending
+	request.NextAttemptAt = time.Now()
+	request.LockedUntil = time.Time{}
+	request.ExpiresAt = time.Time{}
+	request.Attempts = nil
+
+	// Store first, so that the Request can't get lost in between
+	if err := reqStore.StoreRequest(request); err != nil {
+		return err
+	}
+	return reqStore.DeleteDeadLetter(request.ID)
+}
@@ -0,0 +1,358 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eliezedeck/gobase/logging"
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// WebhookSourceConfig is the Source of the Webhooks declared in the config file
+const WebhookSourceConfig = "config"
+
+// configReloadDelay lets the editors finish writing the config file before it is read again
+const configReloadDelay = 500 * time.Millisecond
+
+// declaredWebhook is a Webhook as written in the config file, it is enabled unless told otherwise
+type declaredWebhook struct {
+	*Webhook
+	Enabled *int `json:"enabled"`
+}
+
+// configFile is the content of the config file, either YAML or JSON. The fields are the same as for the
+// administration API.
+type configFile struct {
+	Webhooks []*declaredWebhook `json:"webhooks"`
+}
+
+// LoadConfigFile reads the Webhooks declared in the given YAML or JSON file, they are verified and have their Source
+// set to WebhookSourceConfig. Each of them must have an ID, its Forward URLs are given one when they don't.
+func LoadConfigFile(path string) ([]*Webhook, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// JSON being YAML, both are read the same way. The document then goes through JSON, so that the fields and their
+	// validation are the same as for the administration API.
+	var document interface{}
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	if document == nil {
+		return nil, nil // empty file
+	}
+	asJSON, err := json.Marshal(document)
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(asJSON))
+	decoder.DisallowUnknownFields()
+	file := configFile{}
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	webhooks := make([]*Webhook, 0, len(file.Webhooks))
+	for i, d := range file.Webhooks {
+		if d == nil || d.Webhook == nil {
+			return nil, fmt.Errorf("config file %s: webhook #%d is empty", path, i+1)
+		}
+		w := d.Webhook
+		if w.ID == "" {
+			return nil, fmt.Errorf("config file %s: webhook #%d has no id", path, i+1)
+		}
+		w.Enabled = 1
+		if d.Enabled != nil {
+			w.Enabled = *d.Enabled
+		}
+		w.Source = WebhookSourceConfig
+		for j, furl := range w.ForwardUrls {
+			if furl == nil {
+				return nil, fmt.Errorf("config file %s: webhook %s has an empty forward url", path, w.ID)
+			}
+			if furl.ID == "" {
+				furl.ID = fmt.Sprintf("f-%d", j+1)
+			}
+		}
+		if w.Name == "" || w.Method == "" || w.Path == "" || len(w.ForwardUrls) == 0 {
+			return nil, fmt.Errorf("config file %s: webhook %s must have a name, method, path and forward urls", path, w.ID)
+		}
+		if err := w.Verify(); err != nil {
+			return nil, fmt.Errorf("config file %s: webhook %s: %w", path, w.ID, err)
+		}
+
+		for _, other := range webhooks {
+			if other.ID == w.ID {
+				return nil, fmt.Errorf("config file %s: webhook %s is declared more than once", path, w.ID)
+			}
+			if w.collidesWith(other) {
+				return nil, fmt.Errorf("config file %s: webhooks %s and %s have the same method and path", path, other.ID, w.ID)
+			}
+		}
+		webhooks = append(webhooks, w)
+	}
+	return webhooks, nil
+}
+
+// ConfigPlan is what has to change in the ConfigStorage so that it matches the config file
+type ConfigPlan struct {
+	Add    []*Webhook `json:"add"`
+	Update []*Webhook `json:"update"`
+	Remove []*Webhook `json:"remove"`
+}
+
+func (p *ConfigPlan) IsEmpty() bool {
+	return len(p.Add) == 0 && len(p.Update) == 0 && len(p.Remove) == 0
+}
+
+func (p *ConfigPlan) String() string {
+	if p.IsEmpty() {
+		return "No changes, the webhooks are up to date with the config file\n"
+	}
+	b := &strings.Builder{}
+	for _, w := range p.Add {
+		fmt.Fprintf(b, "+ add     %s: %s %s (%s)\n", w.ID, w.Method, w.Path, w.Name)
+	}
+	for _, w := range p.Update {
+		fmt.Fprintf(b, "~ update  %s: %s %s (%s)\n", w.ID, w.Method, w.Path, w.Name)
+	}
+	for _, w := range p.Remove {
+		fmt.Fprintf(b, "- remove  %s: %s %s (%s)\n", w.ID, w.Method, w.Path, w.Name)
+	}
+	return b.String()
+}
+
+// PlanConfig compares the declared Webhooks with the stored ones. The stored Webhooks that came from the config file
+// but are no longer declared are to be removed; the ones created through the administration are left alone, unless
+// they are declared with the same ID.
+func PlanConfig(config ConfigStorage, declared []*Webhook) (*ConfigPlan, error) {
+	stored, err := config.GetAllWebhooks()
+	if err != nil {
+		return nil, err
+	}
+	storedById := make(map[string]*Webhook, len(stored))
+	for _, w := range stored {
+		storedById[w.ID] = w
+	}
+
+	plan := &ConfigPlan{}
+	declaredById := make(map[string]bool, len(declared))
+	for _, w := range declared {
+		declaredById[w.ID] = true
+		existing, found := storedById[w.ID]
+		if !found {
+			w.CreatedAt = time.Now()
+			plan.Add = append(plan.Add, w)
+			continue
+		}
+		w.CreatedAt = existing.CreatedAt
+		same, err := sameWebhooks(w, existing)
+		if err != nil {
+			return nil, err
+		}
+		if !same {
+			plan.Update = append(plan.Update, w)
+		}
+	}
+	for _, w := range stored {
+		if w.Source == WebhookSourceConfig && !declaredById[w.ID] {
+			plan.Remove = append(plan.Remove, w)
+		}
+	}
+
+	// The declared Webhooks must not collide with the ones that are kept
+	for _, w := range declared {
+		for _, other := range stored {
+			if !declaredById[other.ID] && other.Source != WebhookSourceConfig && w.collidesWith(other) {
+				return nil, fmt.Errorf("webhook %s has the same method and path as the existing webhook %s", w.ID, other.ID)
+			}
+		}
+	}
+
+	sort.Slice(plan.Add, func(i, j int) bool { return plan.Add[i].ID < plan.Add[j].ID })
+	sort.Slice(plan.Update, func(i, j int) bool { return plan.Update[i].ID < plan.Update[j].ID })
+	sort.Slice(plan.Remove, func(i, j int) bool { return plan.Remove[i].ID < plan.Remove[j].ID })
+	return plan, nil
+}
+
+// sameWebhooks compares the Webhooks as they would be returned by the administration API
+func sameWebhooks(a, b *Webhook) (bool, error) {
+	aJSON, err := json.Marshal(a)
+	if err != nil {
+		return false, err
+	}
+	bJSON, err := json.Marshal(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(aJSON, bJSON), nil
+}
+
+// ApplyConfigPlan makes the changes of the plan in the ConfigStorage, and routes the calls accordingly. The plan is
+// applied entirely or not at all: the routes are checked first, and the changes already made in the ConfigStorage are
+// rolled back when a later one fails.
+func ApplyConfigPlan(config ConfigStorage, plan *ConfigPlan) error {
+	unregister := make([]string, 0, len(plan.Remove))
+	for _, w := range plan.Remove {
+		unregister = append(unregister, w.ID)
+	}
+	if err := checkWebhooks(append(append([]*Webhook{}, plan.Update...), plan.Add...), unregister); err != nil {
+		return err
+	}
+
+	var undo []func() error
+	register, err := storeConfigPlan(config, plan, &undo)
+	if err == nil {
+		err = registerWebhooks(register, unregister)
+	}
+	if err != nil {
+		for i := len(undo) - 1; i >= 0; i-- {
+			if undoErr := undo[i](); undoErr != nil {
+				logging.L.Error("Failed to roll back the config plan", zap.Error(undoErr))
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// storeConfigPlan makes the changes of the plan in the ConfigStorage, and returns the Webhooks to register. Each
+// change that is made adds how to undo it.
+func storeConfigPlan(config ConfigStorage, plan *ConfigPlan, undo *[]func() error) ([]*Webhook, error) {
+	for _, w := range plan.Remove {
+		removed := w
+		if err := config.RemoveWebhook(w.ID); err != nil {
+			return nil, err
+		}
+		*undo = append(*undo, func() error {
+			enabled := removed.Enabled
+			if err := config.AddWebhook(removed); err != nil {
+				return err
+			}
+			return keepEnabled(config, removed, enabled)
+		})
+	}
+
+	register := make([]*Webhook, 0, len(plan.Update)+len(plan.Add))
+	for _, w := range plan.Update {
+		previous, err := config.GetWebhook(w.ID)
+		if err != nil {
+			return nil, err
+		}
+		if previous == nil {
+			return nil, fmt.Errorf("webhook with id %s not found", w.ID)
+		}
+		if err := config.UpdateWebhook(w); err != nil {
+			return nil, err
+		}
+		*undo = append(*undo, func() error { return config.UpdateWebhook(previous) })
+		updated, err := config.GetWebhook(w.ID)
+		if err != nil {
+			return nil, err
+		}
+		register = append(register, updated)
+	}
+	for _, w := range plan.Add {
+		added, enabled := w, w.Enabled
+		if err := config.AddWebhook(added); err != nil {
+			return nil, err
+		}
+		*undo = append(*undo, func() error { return config.RemoveWebhook(added.ID) })
+		if err := keepEnabled(config, added, enabled); err != nil {
+			return nil, err
+		}
+		register = append(register, added)
+	}
+	return register, nil
+}
+
+// keepEnabled disables the Webhook that has just been added if it was meant to be, as some storages always enable the
+// new Webhooks
+func keepEnabled(config ConfigStorage, w *Webhook, enabled int) error {
+	if w.Enabled == enabled {
+		return nil
+	}
+	w.Enabled = enabled
+	return config.UpdateWebhook(w)
+}
+
+// SyncConfigFile loads the config file and applies the changes, returns the plan that has been applied
+func SyncConfigFile(config ConfigStorage, path string) (*ConfigPlan, error) {
+	declared, err := LoadConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := PlanConfig(config, declared)
+	if err != nil {
+		return nil, err
+	}
+	return plan, ApplyConfigPlan(config, plan)
+}
+
+// WatchConfigFile syncs the config file again whenever it changes. An invalid file is reported and otherwise
+// ignored, the Webhooks stay as they are until it is fixed.
+func WatchConfigFile(config ConfigStorage, path string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	// The directory is watched rather than the file, as the editors often replace the file instead of writing it
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(absPath)); err != nil {
+		_ = watcher.Close()
+		return err
+	}
+
+	L := logging.L.Named("ConfigFile").With(zap.String("path", path))
+	go func() {
+		defer watcher.Close()
+
+		var reload <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == absPath && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					reload = time.After(configReloadDelay)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				L.Error("Error watching the config file", zap.Error(err))
+			case <-reload:
+				reload = nil
+				plan, err := SyncConfigFile(config, path)
+				if err != nil {
+					L.Error("Config file has not been applied", zap.Error(err))
+					continue
+				}
+				if plan.IsEmpty() {
+					continue
+				}
+				L.Info("Config file has been applied",
+					zap.Int("added", len(plan.Add)),
+					zap.Int("updated", len(plan.Update)),
+					zap.Int("removed", len(plan.Remove)))
+			}
+		}
+	}()
+	L.Info("Watching the config file for changes")
+	return nil
+}
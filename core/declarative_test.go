@@ -0,0 +1,198 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// mapConfig is a ConfigStorage that fails on the Webhook with the ID given in failOn
+type mapConfig struct {
+	webhooks map[string]*Webhook
+	failOn   string
+}
+
+func (m *mapConfig) GetAllWebhooks() ([]*Webhook, error) {
+	webhooks := make([]*Webhook, 0, len(m.webhooks))
+	for _, w := range m.webhooks {
+		webhooks = append(webhooks, w)
+	}
+	return webhooks, nil
+}
+
+func (m *mapConfig) GetWebhook(id string) (*Webhook, error) {
+	return m.webhooks[id], nil
+}
+
+func (m *mapConfig) AddWebhook(webhook *Webhook) error {
+	if webhook.ID == m.failOn {
+		return fmt.Errorf("failed to add %s", webhook.ID)
+	}
+	m.webhooks[webhook.ID] = webhook
+	return nil
+}
+
+func (m *mapConfig) RemoveWebhook(id string) error {
+	if id == m.failOn {
+		return fmt.Errorf("failed to remove %s", id)
+	}
+	delete(m.webhooks, id)
+	return nil
+}
+
+func (m *mapConfig) UpdateWebhook(webhook *Webhook) error {
+	if webhook.ID == m.failOn {
+		return fmt.Errorf("failed to update %s", webhook.ID)
+	}
+	updated := *webhook
+	m.webhooks[webhook.ID] = &updated
+	return nil
+}
+
+func declarativeWebhook(id, path string) *Webhook {
+	return &Webhook{
+		ID:          id,
+		Name:        id,
+		Method:      "POST",
+		Path:        path,
+		Enabled:     1,
+		Source:      WebhookSourceConfig,
+		ForwardUrls: []*ForwardUrl{{ID: "f-1", Url: "http://localhost/" + id, Timeout: Duration(time.Second), ReturnAsResponse: 1}},
+	}
+}
+
+func TestLoadConfigFileDurations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks.yaml")
+	content := `webhooks:
+  - id: w-1
+    name: Orders
+    method: POST
+    path: /orders
+    deduplication:
+      source: header
+      key: Idempotency-Key
+      window: 1h30m
+    forwardUrls:
+      - url: http://localhost/orders
+        timeout: 5s
+        returnAsResponse: 1
+      - url: http://localhost/audit
+        timeout: 2000000000
+`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	webhooks, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := webhooks[0]
+	if got := time.Duration(w.ForwardUrls[0].Timeout); got != 5*time.Second {
+		t.Errorf("timeout = %s, want 5s", got)
+	}
+	if got := time.Duration(w.ForwardUrls[1].Timeout); got != 2*time.Second {
+		t.Errorf("timeout in nanoseconds = %s, want 2s", got)
+	}
+	if got := time.Duration(w.Deduplication.Window); got != 90*time.Minute {
+		t.Errorf("window = %s, want 1h30m", got)
+	}
+
+	if err := os.WriteFile(path, []byte("webhooks:\n  - id: w-1\n    forwardUrls:\n      - timeout: soon\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfigFile(path); err == nil {
+		t.Error("invalid duration has been accepted")
+	}
+}
+
+func TestApplyConfigPlanRollback(t *testing.T) {
+	tests := []struct {
+		name   string
+		failOn string
+		// routed is registered beforehand without being stored, its route can't be taken
+		routed *Webhook
+	}{
+		{name: "add fails", failOn: "w-new"},
+		{name: "update fails", failOn: "w-changed"},
+		{name: "remove fails", failOn: "w-removed"},
+		{name: "route taken", routed: &Webhook{ID: "w-other", Method: "POST", Path: "/new"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			removed := declarativeWebhook("w-removed", "/removed")
+			changed := declarativeWebhook("w-changed", "/changed")
+			config := &mapConfig{webhooks: map[string]*Webhook{removed.ID: removed, changed.ID: changed}}
+			routesMu.Lock()
+			routedWebhooks = map[string]*Webhook{removed.ID: removed, changed.ID: changed}
+			if tt.routed != nil {
+				routedWebhooks[tt.routed.ID] = tt.routed
+			}
+			rebuildRoutes()
+			routesMu.Unlock()
+			defer func() {
+				routesMu.Lock()
+				routedWebhooks = make(map[string]*Webhook)
+				rebuildRoutes()
+				routesMu.Unlock()
+			}()
+
+			plan, err := PlanConfig(config, []*Webhook{
+				declarativeWebhook("w-changed", "/changed-again"),
+				declarativeWebhook("w-new", "/new"),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.failOn = tt.failOn
+			if err := ApplyConfigPlan(config, plan); err == nil {
+				t.Fatal("plan has been applied")
+			}
+
+			// Nothing has changed, neither in the storage nor in the routes
+			if len(config.webhooks) != 2 || config.webhooks["w-removed"] == nil || config.webhooks["w-changed"].Path != "/changed" {
+				t.Errorf("storage has not been rolled back: %v", config.webhooks)
+			}
+			for _, path := range []string{"/removed", "/changed"} {
+				if w := registeredWebhook("w-" + path[1:]); w == nil || w.Path != path {
+					t.Errorf("webhook for %s is no longer routed", path)
+				}
+			}
+			if registeredWebhook("w-new") != nil {
+				t.Error("added webhook has been routed")
+			}
+		})
+	}
+}
+
+func TestApplyConfigPlan(t *testing.T) {
+	removed := declarativeWebhook("w-removed", "/shared")
+	config := &mapConfig{webhooks: map[string]*Webhook{removed.ID: removed}}
+	routesMu.Lock()
+	routedWebhooks = map[string]*Webhook{removed.ID: removed}
+	rebuildRoutes()
+	routesMu.Unlock()
+	defer func() {
+		routesMu.Lock()
+		routedWebhooks = make(map[string]*Webhook)
+		rebuildRoutes()
+		routesMu.Unlock()
+	}()
+
+	// The removed Webhook's route is reused right away
+	plan, err := PlanConfig(config, []*Webhook{declarativeWebhook("w-new", "/shared")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyConfigPlan(config, plan); err != nil {
+		t.Fatal(err)
+	}
+	if registeredWebhook("w-removed") != nil || registeredWebhook("w-new") == nil {
+		t.Error("webhooks have not been routed again")
+	}
+	if len(config.webhooks) != 1 || config.webhooks["w-new"] == nil {
+		t.Errorf("storage has not been updated: %v", config.webhooks)
+	}
+}
@@ -0,0 +1,181 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// DedupSourceHeader takes the key from a header, such as `X-GitHub-Delivery` or `Idempotency-Key`
+	DedupSourceHeader = "header"
+	// DedupSourceBody takes the key from the JSON body, with a gjson path
+	DedupSourceBody = "body"
+	// DedupSourceBodyHash takes the SHA-256 of the whole body as the key
+	DedupSourceBodyHash = "bodyHash"
+
+	defaultDedupWindow = 24 * time.Hour
+)
+
+// Deduplication suppresses the calls that have the same key as a previous one within the Window: they get the
+// response of the original call, without being stored or forwarded again. The calls without a key always go through.
+// It is not stored directly in the database but as a child/nested object of the Webhook.
+type Deduplication struct {
+	Source string `bson:"source"  json:"source"`
+	// Key is the header name, or the gjson path of the body; unused for the body hash
+	Key string `bson:"key"  json:"key"`
+	// Window during which a key is remembered, defaults to 24 hours
+	Window Duration `bson:"window"  json:"window"`
+}
+
+func (d *Deduplication) Verify() error {
+	switch d.Source {
+	case DedupSourceHeader, DedupSourceBody:
+		if d.Key == "" {
+			return fmt.Errorf("deduplication on the %s must have a key", d.Source)
+		}
+	case DedupSourceBodyHash:
+	default:
+		return fmt.Errorf("invalid deduplication source: %q", d.Source)
+	}
+	if d.Window < 0 {
+		return fmt.Errorf("deduplication window must not be negative")
+	}
+	return nil
+}
+
+// keyOf returns the key of the call, empty if it doesn't have any. The body path looks into the body decompressed,
+// when it can be; whereas the hash is always the one of the body as it was sent, be it spooled or stored decompressed.
+func (d *Deduplication) keyOf(header http.Header, body *payload) string {
+	switch d.Source {
+	case DedupSourceHeader:
+		return header.Get(d.Key)
+	case DedupSourceBody:
+		return gjson.GetBytes(body.content, d.Key).String()
+	case DedupSourceBodyHash:
+		content, err := body.openSent()
+		if err != nil {
+			return ""
+		}
+		defer func() {
+			_ = content.Close()
+		}()
+		sum := sha256.New()
+		if _, err := io.Copy(sum, content); err != nil {
+			return ""
+		}
+		return hex.EncodeToString(sum.Sum(nil))
+	}
+	return ""
+}
+
+func (d *Deduplication) window() time.Duration {
+	if d.Window <= 0 {
+		return defaultDedupWindow
+	}
+	return time.Duration(d.Window)
+}
+
+// IdempotencyRecord remembers a call to a Webhook by its deduplication key, along with the response it got. It is
+// stored on its own, so that the duplicates are recognized across restarts and instances.
+type IdempotencyRecord struct {
+	// ID is derived from the Webhook ID and the key
+	ID        string `bson:"_id"        json:"id"`
+	WebhookId string `bson:"webhookId"  json:"webhookId"`
+	Key       string `bson:"key"        json:"key"`
+	// RequestId is the ID of the original call, its Requests are suffixed with the Forward URL IDs
+	RequestId string `bson:"requestId"  json:"requestId"`
+
+	// The response of the original call, StatusCode is 0 while it is still being handled
+	StatusCode int                 `bson:"statusCode"  json:"statusCode"`
+	Headers    map[string][]string `bson:"headers"     json:"headers"`
+	Body       []byte              `bson:"body"        json:"body"`
+
+	CreatedAt time.Time `bson:"createdAt"  json:"createdAt"`
+	// ExpiresAt is the end of the deduplication window, the record is purged afterwards
+	ExpiresAt time.Time `bson:"expiresAt"  json:"expiresAt"`
+	// LockedUntil is how long the original call holds the key while it is handled. Past it, the original is deemed lost
+	// (e.g. the instance has crashed) and another call with the same key can take the key over.
+	LockedUntil time.Time `bson:"lockedUntil"  json:"lockedUntil"`
+}
+
+func newIdempotencyRecord(webhookId, key, requestId string, window, lease time.Duration,
+	now time.Time) *IdempotencyRecord {
+	sum := sha256.Sum256([]byte(webhookId + "\x00" + key))
+	return &IdempotencyRecord{
+		ID:          fmt.Sprintf("i-%s", hex.EncodeToString(sum[:])),
+		WebhookId:   webhookId,
+		Key:         key,
+		RequestId:   requestId,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(window),
+		LockedUntil: now.Add(lease),
+	}
+}
+
+// Holds tells if the record still keeps the calls with the same key from going through at `now`: until it expires
+// once it is settled, only during its lease while the original call is being handled.
+func (r *IdempotencyRecord) Holds(now time.Time) bool {
+	if r.StatusCode == 0 {
+		return r.LockedUntil.After(now) && r.ExpiresAt.After(now)
+	}
+	return r.ExpiresAt.After(now)
+}
+
+// idempotencyLease is how long the original call may take to be handled: its longest forward, with some margin
+func (w *Webhook) idempotencyLease() time.Duration {
+	lease := time.Duration(0)
+	for _, furl := range w.ForwardUrls {
+		if time.Duration(furl.Timeout) > lease {
+			lease = time.Duration(furl.Timeout)
+		}
+	}
+	return lease + deliveryLease
+}
+
+// replay gives the duplicate the response of the original call, once it is settled. If the original is still being
+// handled, the caller is told to retry later.
+func (r *IdempotencyRecord) replay(c echo.Context) error {
+	if r.StatusCode == 0 {
+		return c.String(http.StatusConflict, "409 Conflict")
+	}
+	for name, values := range r.Headers {
+		for _, v := range values {
+			c.Response().Header().Add(name, v)
+		}
+	}
+	c.Response().WriteHeader(r.StatusCode)
+	_, err := c.Response().Write(r.Body)
+	return err
+}
+
+// settleIdempotencyKey saves the response of the original call once it has been written. The key is released if the
+// call has failed instead, so that the retries of the provider go through.
+func settleIdempotencyKey(storage RequestsStorage, record *IdempotencyRecord, response *echo.Response,
+	recorder *recordingWriter) error {
+	if !response.Committed || response.Status >= http.StatusInternalServerError {
+		return storage.ReleaseIdempotencyKey(record)
+	}
+	record.StatusCode = response.Status
+	record.Headers = response.Header().Clone()
+	record.Body = append([]byte{}, recorder.body.Bytes()...)
+	return storage.CompleteIdempotencyKey(record)
+}
+
+// recordingWriter keeps a copy of the response body, so that it can be given to the duplicates
+type recordingWriter struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
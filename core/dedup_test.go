@@ -0,0 +1,37 @@
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"testing"
+)
+
+func TestDeduplicationKeyOf(t *testing.T) {
+	compressed := &bytes.Buffer{}
+	gz := gzip.NewWriter(compressed)
+	_, _ = gz.Write([]byte(`{"id":"evt_1"}`))
+	_ = gz.Close()
+
+	sent := func() *payload {
+		return &payload{inline: compressed.Bytes(), content: compressed.Bytes(), size: int64(compressed.Len())}
+	}
+	decompressed := sent()
+	if ok, err := decompressed.decompress("gzip", 0); !ok || err != nil {
+		t.Fatalf("decompress = %v, %v", ok, err)
+	}
+	stored := sent()
+	_, _ = stored.decompress("gzip", 0)
+	stored.keepDecompressed()
+
+	byHash := &Deduplication{Source: DedupSourceBodyHash}
+	byPath := &Deduplication{Source: DedupSourceBody, Key: "id"}
+	for name, body := range map[string]*payload{"decompressed": decompressed, "stored decompressed": stored} {
+		if got, want := byHash.keyOf(http.Header{}, body), byHash.keyOf(http.Header{}, sent()); got != want {
+			t.Errorf("%s: hash = %s, want the one of the body as it was sent %s", name, got, want)
+		}
+		if got := byPath.keyOf(http.Header{}, body); got != "evt_1" {
+			t.Errorf("%s: key = %q, want evt_1", name, got)
+		}
+	}
+}
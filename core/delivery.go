@@ -0,0 +1,183 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/eliezedeck/gobase/logging"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	// deliveryLease is how long a claimed Request is reserved for a single delivery worker, on top of the forward's
+	// own timeout. If the process dies in the meantime, the Request is picked up again once this lease has expired.
+	deliveryLease = 5 * time.Minute
+
+	deliveryPollInterval = 1 * time.Second
+)
+
+// deliveryWorker delivers the pending Requests from the storage: the ones that have failed in the Webhook handler and
+// are due for a retry, as well as the ones that were in flight when the process died.
+type deliveryWorker struct {
+	config  ConfigStorage
+	storage RequestsStorage
+	jobs    chan *Request
+	count   int
+}
+
+// StartDeliveryWorkers starts `count` background workers that are going to deliver the pending Requests. Without
+// them, failed forwards are never retried. Each Request is forwarded as per its Forward URL as it is configured at the
+// time, the ones whose Forward URL is gone are moved to the dead letters.
+func StartDeliveryWorkers(config ConfigStorage, storage RequestsStorage, count int) {
+	d := &deliveryWorker{
+		config:  config,
+		storage: storage,
+		jobs:    make(chan *Request, count),
+		count:   count,
+	}
+	for i := 0; i < count; i++ {
+		go d.run()
+	}
+	go d.poll()
+	logging.L.Info("Delivery workers started", zap.Int("count", count))
+}
+
+func (d *deliveryWorker) poll() {
+	ticker := time.NewTicker(deliveryPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		requests, err := d.storage.ClaimPendingRequests(time.Now(), deliveryLease, d.count)
+		if err != nil {
+			logging.L.Error("Error claiming pending requests", zap.Error(err))
+			continue
+		}
+		for _, request := range requests {
+			d.jobs <- request
+		}
+	}
+}
+
+func (d *deliveryWorker) run() {
+	for request := range d.jobs {
+		d.deliver(request)
+	}
+}
+
+func (d *deliveryWorker) deliver(request *Request) {
+	L := logging.L.Named(fmt.Sprintf("Delivery[%s:%s]", request.FromWebhookId, request.ForwardUrl.ID)).With(
+		zap.String("requestId", request.ID),
+		zap.Int("attempt", len(request.Attempts)+1))
+
+	// The Webhook may have been edited since the call, or its Forward URL removed
+	furl, err := currentForwardUrl(d.config, request.FromWebhookId, request.ForwardUrl.ID)
+	if err != nil {
+		// Picked up again once the lease has expired
+		L.Error("Error looking up the forward URL", zap.Error(err))
+		return
+	}
+	if furl == nil {
+		if err := removedForward(d.storage, request); err != nil {
+			L.Error("Error moving the request to the dead letters", zap.Error(err))
+			return
+		}
+		L.Warn("Forward URL has been removed, the request has been moved to the dead letters")
+		return
+	}
+	request.setForwardUrl(furl)
+
+	// Each delivery is a trace of its own, the call to the Webhook is long gone
+	traceCtx, span := tracer.Start(context.Background(), fmt.Sprintf("delivery %s", furl.ID),
+		trace.WithAttributes(
+			attribute.String("webhook.id", request.FromWebhookId),
+			attribute.String("request.id", request.ID)))
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(traceCtx, time.Duration(furl.Timeout))
+	// The worker only waits a little for the turn of the Request, so that it doesn't hold up the other Forward URLs
+	var response *http.Response
+	waitCtx, cancelWait := context.WithTimeout(ctx, forwardQueueDelay)
+	release, err := throttleForward(waitCtx, request, true)
+	cancelWait()
+	if err == nil {
+		response, _, err = forwardRequest(ctx, d.storage, request)
+		release()
+	}
+	cancel()
+	if errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrForwardQueued) {
+		L.Info("Forward is held back", zap.Error(err))
+	} else if err != nil {
+		L.Warn("Forward has failed", zap.Error(err))
+	} else {
+		L.Info("Forward has been made", zap.Int("status", response.StatusCode))
+	}
+
+	if err := settleRequest(traceCtx, d.storage, request, response, err, false); err != nil {
+		L.Error("Error updating request after forward", zap.Error(err))
+		return
+	}
+	switch request.Status {
+	case RequestStatusPending:
+		L.Info("Forward is going to be retried", zap.Time("nextAttemptAt", request.NextAttemptAt))
+	case RequestStatusDeadLetter:
+		L.Warn("No more retries, the request has been moved to the dead letters")
+	}
+}
+
+// removedForward moves the Request to the dead letters, its Forward URL doesn't exist anymore
+func removedForward(storage RequestsStorage, request *Request) error {
+	request.Status = RequestStatusDeadLetter
+	request.LockedUntil = time.Time{}
+	request.Rejection = "forward URL has been removed"
+	request.ExpiresAt = retentionFor(request.FromWebhookId).expiresAt(request.Status, time.Now())
+	return storage.MoveToDeadLetters(request)
+}
+
+// settleRequest updates the stored Request according to the outcome of its latest forward: a delivered Request is
+// deleted unless it has to be kept, a failed one is either scheduled for a retry or moved to the dead letters.
+func settleRequest(ctx context.Context, storage RequestsStorage, request *Request, response *http.Response, err error, keep bool) error {
+	furl := request.forwardUrl()
+	request.LockedUntil = time.Time{}
+
+	update := func() error {
+		return storage.UpdateRequest(request)
+	}
+	if errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrForwardQueued) {
+		// Nothing has been attempted, the Request stays pending until it can be forwarded
+		return traceStorage(ctx, "UpdateRequest", request.ID, update)
+	}
+	if err == nil && !furl.Retry.IsRetryableStatus(response.StatusCode) {
+		request.Status = RequestStatusDelivered
+		request.ExpiresAt = retentionFor(request.FromWebhookId).expiresAt(request.Status, time.Now())
+		if keep || furl.KeepSuccessfulRequests >= 1 {
+			return traceStorage(ctx, "UpdateRequest", request.ID, update)
+		}
+		return traceStorage(ctx, "DeleteRequest", request.ID, func() error {
+			if err := storage.DeleteDeliveryAttempts(request.ID); err != nil {
+				return err
+			}
+			if err := storage.DeleteRequest(request.ID); err != nil {
+				return err
+			}
+			if request.BodyBlob != "" {
+				deleteBlob(request.BodyBlob)
+			}
+			return nil
+		})
+	}
+
+	if furl.Retry.CanRetry(len(request.Attempts)) {
+		request.NextAttemptAt = time.Now().Add(furl.Retry.NextDelay(len(request.Attempts)))
+		return traceStorage(ctx, "UpdateRequest", request.ID, update)
+	}
+	request.Status = RequestStatusDeadLetter
+	request.ExpiresAt = retentionFor(request.FromWebhookId).expiresAt(request.Status, time.Now())
+	return traceStorage(ctx, "MoveToDeadLetters", request.ID, func() error {
+		return storage.MoveToDeadLetters(request)
+	})
+}
@@ -0,0 +1,123 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eliezedeck/gobase/logging"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	logging.L = zap.NewNop()
+	os.Exit(m.Run())
+}
+
+// fakeConfig only knows the Webhooks it is given
+type fakeConfig struct {
+	ConfigStorage
+	webhooks map[string]*Webhook
+}
+
+func (f *fakeConfig) GetWebhook(id string) (*Webhook, error) {
+	return f.webhooks[id], nil
+}
+
+// fakeRequests keeps what the delivery does to the Request
+type fakeRequests struct {
+	RequestsStorage
+	updated     *Request
+	deadLetters []*Request
+	deleted     []string
+	attempts    []*DeliveryAttempt
+}
+
+func (f *fakeRequests) UpdateRequest(request *Request) error {
+	f.updated = request
+	return nil
+}
+
+func (f *fakeRequests) MoveToDeadLetters(request *Request) error {
+	f.deadLetters = append(f.deadLetters, request)
+	return nil
+}
+
+func (f *fakeRequests) DeleteRequest(id string) error {
+	f.deleted = append(f.deleted, id)
+	return nil
+}
+
+func (f *fakeRequests) DeleteDeliveryAttempts(string) error {
+	return nil
+}
+
+func (f *fakeRequests) StoreDeliveryAttempt(attempt *DeliveryAttempt) error {
+	f.attempts = append(f.attempts, attempt)
+	return nil
+}
+
+func TestDeliverCurrentForwardUrl(t *testing.T) {
+	var signature string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get("webhook-signature")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer receiver.Close()
+
+	// The request was received before the Forward URL was moved, and its secret rotated
+	stored := &ForwardUrl{ID: "f-1", Url: "http://127.0.0.1:1/old", Timeout: Duration(time.Second),
+		Signing: &OutboundSigning{Secrets: []string{"old-secret"}}}
+	current := &ForwardUrl{ID: "f-1", Url: receiver.URL, Timeout: Duration(time.Second),
+		Signing: &OutboundSigning{Secrets: []string{"new-secret"}}}
+	config := &fakeConfig{webhooks: map[string]*Webhook{
+		"w-1": {ID: "w-1", ForwardUrls: []*ForwardUrl{current}},
+		"w-2": {ID: "w-2"},
+	}}
+
+	newRequest := func(webhookId string) *Request {
+		request := &Request{ID: "r-" + webhookId, Method: "POST", Body: []byte("{}"), FromWebhookId: webhookId,
+			Status: RequestStatusPending}
+		request.setForwardUrl(stored)
+		return request
+	}
+	if newRequest("w-1").ForwardUrl.Signing != nil {
+		t.Fatal("the secrets must not be stored along with the request")
+	}
+
+	t.Run("edited and rotated", func(t *testing.T) {
+		storage := &fakeRequests{}
+		worker := &deliveryWorker{config: config, storage: storage}
+		worker.deliver(newRequest("w-1"))
+
+		if len(storage.attempts) != 1 || storage.attempts[0].Url != receiver.URL || storage.attempts[0].Error != "" {
+			t.Fatalf("attempts = %+v, want a single one to %s", storage.attempts, receiver.URL)
+		}
+		if !strings.HasPrefix(signature, "v1,") {
+			t.Fatalf("signature = %q, want one", signature)
+		}
+		check := &OutboundSigning{Secrets: []string{"new-secret"}}
+		header := http.Header{}
+		_ = check.Sign(header, "r-w-1", strings.NewReader("{}"), time.Unix(storage.attempts[0].StartedAt.Unix(), 0))
+		if header.Get("webhook-signature") != signature {
+			t.Errorf("signature = %s, want the one of the new secret %s", signature, header.Get("webhook-signature"))
+		}
+	})
+
+	t.Run("removed", func(t *testing.T) {
+		storage := &fakeRequests{}
+		worker := &deliveryWorker{config: config, storage: storage}
+		worker.deliver(newRequest("w-2"))
+
+		if len(storage.attempts) != 0 {
+			t.Errorf("attempts = %+v, want none", storage.attempts)
+		}
+		if len(storage.deadLetters) != 1 || storage.deadLetters[0].Status != RequestStatusDeadLetter ||
+			storage.deadLetters[0].Rejection == "" {
+			t.Errorf("dead letters = %+v, want the request", storage.deadLetters)
+		}
+	})
+}
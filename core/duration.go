@@ -0,0 +1,36 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Duration is a time.Duration that can be given in JSON (and YAML) either as a number of nanoseconds or as a string
+// such as "5s" or "1h30m". It is always marshaled as a number of nanoseconds, as it has always been stored.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var value string
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q: %w", value, err)
+		}
+		*d = Duration(parsed)
+		return nil
+	}
+	var nanos int64
+	if err := json.Unmarshal(data, &nanos); err != nil {
+		return fmt.Errorf("invalid duration: %s", data)
+	}
+	*d = Duration(nanos)
+	return nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
@@ -1,18 +1,37 @@
 package core
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"net/http"
 	"strings"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ForwardUrl struct {
-	ID                     string        `bson:"_id"                     json:"id"`
-	Url                    string        `bson:"url"                     json:"url"                      validate:"required"`
-	KeepSuccessfulRequests int           `bson:"keepSuccessfulRequests"  json:"keepSuccessfulRequests"`
-	Timeout                time.Duration `bson:"timeout"                 json:"timeout"                  validate:"required"`
-	ReturnAsResponse       int           `bson:"returnAsResponse"        json:"returnAsResponse"         validate:"required"`
-	WaitTillCompletion     int           `bson:"waitTillCompletion"      json:"waitForCompletion"        validate:"required"`
+	ID                     string           `bson:"_id"                     json:"id"`
+	Url                    string           `bson:"url"                     json:"url"                      validate:"required"`
+	KeepSuccessfulRequests int              `bson:"keepSuccessfulRequests"  json:"keepSuccessfulRequests"`
+	Timeout                Duration         `bson:"timeout"                 json:"timeout"                  validate:"required"`
+	ReturnAsResponse       int              `bson:"returnAsResponse"        json:"returnAsResponse"         validate:"required"`
+	WaitTillCompletion     int              `bson:"waitTillCompletion"      json:"waitForCompletion"        validate:"required"`
+	Retry                  *RetryPolicy     `bson:"retry"                   json:"retry"`
+	Signing                *OutboundSigning `bson:"signing"                 json:"signing"`
+	// Match restricts the calls that are forwarded, the others are skipped
+	Match MatchRules `bson:"match" json:"match"`
+	// Transform reshapes the calls before they are forwarded, optional
+	Transform *Transform `bson:"transform" json:"transform"`
+	// CircuitBreaker stops forwarding for a while after repeated failures, optional
+	CircuitBreaker *CircuitBreakerPolicy `bson:"circuitBreaker" json:"circuitBreaker"`
+	// RateLimit caps the rate and the concurrency of the forwards, optional
+	RateLimit *ForwardRateLimit `bson:"rateLimit" json:"rateLimit"`
 }
 
 var (
@@ -29,3 +48,155 @@ func TransferHeaders(dest, source http.Header) {
 		}
 	}
 }
+
+// withoutSecrets returns the copy of the ForwardUrl that is stored along with its Requests
+func (f *ForwardUrl) withoutSecrets() *ForwardUrl {
+	clone := *f
+	clone.Signing = nil
+	return &clone
+}
+
+// setForwardUrl makes the Request forwarded with the ForwardUrl as it is configured right now
+func (r *Request) setForwardUrl(furl *ForwardUrl) {
+	r.forward = furl
+	r.ForwardUrl = furl.withoutSecrets()
+}
+
+// forwardUrl returns the ForwardUrl to forward the Request with, the stored copy if it hasn't been looked up
+func (r *Request) forwardUrl() *ForwardUrl {
+	if r.forward != nil {
+		return r.forward
+	}
+	return r.ForwardUrl
+}
+
+// currentForwardUrl looks the ForwardUrl up on its Webhook as it is configured right now, the registered one or else
+// the stored one; nil if either is gone.
+func currentForwardUrl(config ConfigStorage, webhookId, forwardUrlId string) (*ForwardUrl, error) {
+	webhook := registeredWebhook(webhookId)
+	if webhook == nil {
+		var err error
+		if webhook, err = config.GetWebhook(webhookId); err != nil || webhook == nil {
+			return nil, err
+		}
+	}
+	for _, furl := range webhook.ForwardUrls {
+		if furl.ID == forwardUrlId {
+			return furl, nil
+		}
+	}
+	return nil, nil
+}
+
+// forwardRequest sends the given Request to its ForwardUrl and records the outcome as a new Attempt on the Request, as
+// well as a full DeliveryAttempt in the storage. The response body is always fully read and returned, the response
+// itself is already closed.
+//
+// While the circuit breaker of the ForwardUrl is open, nothing is attempted: ErrCircuitOpen is returned and the
+// Request is due when the breaker lets it through.
+func forwardRequest(ctx context.Context, storage RequestsStorage, request *Request) (*http.Response, []byte, error) {
+	furl := request.forwardUrl()
+	breaker := circuitBreakerFor(request.FromWebhookId, furl)
+	if breaker != nil {
+		if allowed, retryAt := breaker.allow(time.Now()); !allowed {
+			request.NextAttemptAt = retryAt
+			metricCircuitShortCircuits.WithLabelValues(request.FromWebhookId, furl.ID).Inc()
+			return nil, nil, ErrCircuitOpen
+		}
+	}
+
+	attempt := &Attempt{At: time.Now()}
+	request.Attempts = append(request.Attempts, attempt)
+	delivery := newDeliveryAttempt(request, attempt)
+	defer storeDeliveryAttempt(storage, delivery)
+	if breaker != nil {
+		defer func() {
+			success := delivery.Error == "" && !furl.Retry.IsRetryableStatus(delivery.StatusCode)
+			breaker.record(success, time.Now())
+		}()
+	}
+
+	ctx, span := tracer.Start(ctx, fmt.Sprintf("forward %s", furl.ID), trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("webhook.id", request.FromWebhookId),
+			attribute.String("forward_url.id", furl.ID),
+			attribute.String("request.id", request.ID),
+			attribute.Int("attempt", delivery.Number),
+			semconv.HTTPMethodKey.String(request.Method),
+			semconv.HTTPURLKey.String(furl.Url)))
+	defer func() {
+		if delivery.StatusCode != 0 {
+			span.SetAttributes(semconv.HTTPStatusCodeKey.Int(delivery.StatusCode))
+		}
+		if delivery.Error != "" {
+			span.SetStatus(codes.Error, delivery.Error)
+		}
+		span.End()
+	}()
+
+	// Prepare a new request as per the Transform, transfer the headers and our trace context
+	transformed, err := furl.Transform.Apply(request, furl.Url)
+	if err != nil {
+		attempt.Error = err.Error()
+		delivery.Error = attempt.Error
+		return nil, nil, err
+	}
+	delivery.Url = transformed.Url
+	body, err := transformed.openBody(request)
+	if err != nil {
+		attempt.Error = err.Error()
+		delivery.Error = attempt.Error
+		return nil, nil, err
+	}
+	freq, err := http.NewRequestWithContext(ctx, transformed.Method, transformed.Url, body)
+	if err != nil {
+		closeBody(body)
+		attempt.Error = err.Error()
+		delivery.Error = attempt.Error
+		return nil, nil, err
+	}
+	if request.BodyBlob != "" {
+		// Streamed from the spool, it is sent as is
+		freq.ContentLength = request.BodySize
+	}
+	TransferHeaders(freq.Header, transformed.Headers)
+	propagator.Inject(ctx, propagation.HeaderCarrier(freq.Header))
+	if furl.Signing != nil {
+		// The body is read a first time for the signature
+		content, err := transformed.openBody(request)
+		if err == nil {
+			err = furl.Signing.Sign(freq.Header, request.ID, content, attempt.At)
+			closeBody(content)
+		}
+		if err != nil {
+			closeBody(body)
+			attempt.Error = err.Error()
+			delivery.Error = attempt.Error
+			return nil, nil, err
+		}
+	}
+
+	// Execute the request
+	response, err := ForwardHttpClient.Do(freq)
+	if err != nil {
+		// Error executing: Rebuilt request -> Forwarded host
+		attempt.Error = err.Error()
+		delivery.Error = attempt.Error
+		return nil, nil, err
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	attempt.StatusCode = response.StatusCode
+
+	// Always fully read the body
+	fbody, err := io.ReadAll(response.Body)
+	delivery.setResponse(response, fbody)
+	if err != nil {
+		// Error reading: Body <- Forwarded host
+		attempt.Error = err.Error()
+		delivery.Error = attempt.Error
+		return nil, nil, err
+	}
+	return response, fbody, nil
+}
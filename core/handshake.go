@@ -0,0 +1,103 @@
+package core
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// HandshakeSlack answers the `url_verification` event of the Slack Events API
+	HandshakeSlack = "slack"
+	// HandshakeMeta answers the `hub.challenge` of the Meta (Facebook, Instagram, WhatsApp) webhooks, it is a GET
+	HandshakeMeta = "meta"
+	// HandshakeMsGraph answers the `validationToken` of the Microsoft Graph subscriptions
+	HandshakeMsGraph = "msgraph"
+	// HandshakeWebSub answers the intent verification of a WebSub hub, it is a GET
+	HandshakeWebSub = "websub"
+	// HandshakeZoom answers the `endpoint.url_validation` event of Zoom
+	HandshakeZoom = "zoom"
+)
+
+// Handshake answers the verification challenge that a provider sends before it sends any event. The challenges are
+// answered right away, they are neither forwarded nor stored. It is not stored directly in the database but as a
+// child/nested object of the Webhook.
+type Handshake struct {
+	Provider string `bson:"provider"  json:"provider"`
+	// Token is the verify token of Meta, which must be the same as `hub.verify_token`, or the secret token of Zoom,
+	// which signs the answer
+	Token string `bson:"token"  json:"token"`
+	// Topic is the WebSub topic that is subscribed to, any topic is accepted if empty
+	Topic string `bson:"topic"  json:"topic"`
+}
+
+func (h *Handshake) Verify() error {
+	switch h.Provider {
+	case HandshakeSlack, HandshakeMsGraph, HandshakeWebSub:
+		return nil
+	case HandshakeMeta, HandshakeZoom:
+		if h.Token == "" {
+			return fmt.Errorf("%s handshake requires a token", h.Provider)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported handshake provider: %s", h.Provider)
+}
+
+// usesGet tells if the challenge comes as a GET, whatever the Method of the Webhook
+func (h *Handshake) usesGet() bool {
+	return h.Provider == HandshakeMeta || h.Provider == HandshakeWebSub
+}
+
+// answer responds to the call if it is the challenge of the provider; it returns false, without responding, if it
+// isn't one.
+func (h *Handshake) answer(c echo.Context, body []byte) (bool, error) {
+	r := c.Request()
+	query := r.URL.Query()
+	switch h.Provider {
+	case HandshakeSlack:
+		if r.Method != http.MethodPost || gjson.GetBytes(body, "type").String() != "url_verification" {
+			return false, nil
+		}
+		return true, c.JSON(http.StatusOK, map[string]string{"challenge": gjson.GetBytes(body, "challenge").String()})
+
+	case HandshakeMeta:
+		if r.Method != http.MethodGet || query.Get("hub.mode") != "subscribe" {
+			return false, nil
+		}
+		if query.Get("hub.verify_token") != h.Token {
+			return true, c.String(http.StatusForbidden, "403 Forbidden")
+		}
+		return true, c.String(http.StatusOK, query.Get("hub.challenge"))
+
+	case HandshakeMsGraph:
+		if !query.Has("validationToken") {
+			return false, nil
+		}
+		return true, c.String(http.StatusOK, query.Get("validationToken"))
+
+	case HandshakeWebSub:
+		mode := query.Get("hub.mode")
+		if r.Method != http.MethodGet || (mode != "subscribe" && mode != "unsubscribe") {
+			return false, nil
+		}
+		if h.Topic != "" && query.Get("hub.topic") != h.Topic {
+			return true, c.String(http.StatusNotFound, "404 Not Found")
+		}
+		return true, c.String(http.StatusOK, query.Get("hub.challenge"))
+
+	case HandshakeZoom:
+		if r.Method != http.MethodPost || gjson.GetBytes(body, "event").String() != "endpoint.url_validation" {
+			return false, nil
+		}
+		plainToken := gjson.GetBytes(body, "payload.plainToken").String()
+		return true, c.JSON(http.StatusOK, map[string]string{
+			"plainToken":     plainToken,
+			"encryptedToken": hexHMAC(sha256.New, h.Token, []byte(plainToken)),
+		})
+	}
+	return false, nil
+}
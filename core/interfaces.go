@@ -1,5 +1,10 @@
 package core
 
+import (
+	"io"
+	"time"
+)
+
 type ConfigStorage interface {
 	GetAllWebhooks() ([]*Webhook, error)
 	GetWebhook(id string) (*Webhook, error)
@@ -9,10 +14,66 @@ type ConfigStorage interface {
 	UpdateWebhook(webhook *Webhook) error
 }
 
+// SelfExpiringStorage is implemented by the RequestsStorage that delete the expired Requests by themselves, such as
+// MongoDB with its TTL indexes. Their PurgeExpiredRequests has nothing to do, and can't count them.
+type SelfExpiringStorage interface {
+	ExpiresRequests() bool
+}
+
 type RequestsStorage interface {
 	StoreRequest(request *Request) error
+	UpdateRequest(request *Request) error
 	GetOldestRequests(count int) ([]*Request, error)
 	GetNewestRequests(count int) ([]*Request, error)
 	GetRequest(id string) (*Request, error)
+	// QueryRequests returns up to `query.Limit` Requests matching the query, in the order of the query
+	QueryRequests(query *RequestQuery) ([]*Request, error)
 	DeleteRequest(id string) error
+
+	// CountPendingRequests returns how many Requests are waiting to be delivered
+	CountPendingRequests() (int, error)
+	// ClaimPendingRequests returns up to `count` pending Requests that are due for delivery at `now`, and reserves them
+	// for the caller during `lease` so that no other delivery worker picks them up in the meantime.
+	ClaimPendingRequests(now time.Time, lease time.Duration, count int) ([]*Request, error)
+
+	// MoveToDeadLetters moves a Request that has run out of retries away from the other Requests
+	MoveToDeadLetters(request *Request) error
+	GetDeadLetters(filter DeadLetterFilter, count int) ([]*Request, error)
+	GetDeadLetter(id string) (*Request, error)
+	DeleteDeadLetter(id string) error
+	PurgeDeadLetters(filter DeadLetterFilter) (int, error)
+
+	// StoreDeliveryAttempt records a single forward of a Request, whether it is still stored or a dead letter
+	StoreDeliveryAttempt(attempt *DeliveryAttempt) error
+	// GetDeliveryAttempts returns the DeliveryAttempts of the Request, oldest first
+	GetDeliveryAttempts(requestId string) ([]*DeliveryAttempt, error)
+	DeleteDeliveryAttempts(requestId string) error
+
+	// ClaimIdempotencyKey stores the record, unless there already is one with the same ID that still Holds at `now`:
+	// that one is returned instead. It returns nil once the record is stored.
+	ClaimIdempotencyKey(record *IdempotencyRecord, now time.Time) (*IdempotencyRecord, error)
+	// CompleteIdempotencyKey saves the response of the original call on its record, unless the key has been taken over
+	// by another call in the meantime
+	CompleteIdempotencyKey(record *IdempotencyRecord) error
+	// ReleaseIdempotencyKey deletes the record, so that the next call with the same key goes through; unless the key
+	// has been taken over by another call in the meantime
+	ReleaseIdempotencyKey(record *IdempotencyRecord) error
+
+	// PurgeExpiredRequests deletes the Requests, dead letters, DeliveryAttempts and IdempotencyRecords that have expired
+	// at `now`. Only the Requests and dead letters are counted.
+	PurgeExpiredRequests(now time.Time) (int, error)
+	// TrimRequests deletes the oldest Requests of the Webhook so that only `keep` of them remain, pending ones excluded
+	TrimRequests(webhookId string, keep int) (int, error)
+}
+
+// BlobStorage keeps the bodies that are too large to be stored inline with their Request, see SetupBodySpool. Each
+// blob belongs to the Request of the same ID.
+type BlobStorage interface {
+	// StoreBlob saves the whole content under the ID, replacing any previous blob; it returns the size of the content.
+	// Nothing is kept if the content can't be fully read.
+	StoreBlob(id string, content io.Reader) (int64, error)
+	OpenBlob(id string) (io.ReadCloser, error)
+	DeleteBlob(id string) error
+	// ListBlobs returns the IDs of the blobs that have been stored before `before`
+	ListBlobs(before time.Time) ([]string, error)
 }
@@ -0,0 +1,149 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	MatchSourceMethod = "method"
+	MatchSourceHeader = "header"
+	MatchSourceQuery  = "query"
+	// MatchSourceBody takes the value from the JSON body, with a gjson path
+	MatchSourceBody = "body"
+)
+
+// MatchRule is a condition on the incoming call for a ForwardUrl to receive it. It is not stored directly in the
+// database but as a child/nested object of the ForwardUrl.
+type MatchRule struct {
+	// Source of the value that is checked: method, header, query or body
+	Source string `bson:"source"  json:"source"`
+	// Key is the header name, the query parameter name or the gjson path of the body; unused for the method
+	Key string `bson:"key"  json:"key"`
+
+	// Exactly one of Equals, Regex or Exists is to be set. Equals is case-insensitive for the method.
+	Equals string `bson:"equals"  json:"equals"`
+	Regex  string `bson:"regex"   json:"regex"`
+	Exists int    `bson:"exists"  json:"exists"`
+	// Negate inverts the outcome of the rule
+	Negate int `bson:"negate"  json:"negate"`
+
+	regex *regexp.Regexp
+}
+
+// MatchRules must all match for the ForwardUrl to receive the call, there is no condition if empty
+type MatchRules []*MatchRule
+
+func (rules MatchRules) Verify() error {
+	for _, r := range rules {
+		if r == nil {
+			return fmt.Errorf("match rule must not be empty")
+		}
+		switch r.Source {
+		case MatchSourceMethod:
+			if r.Exists >= 1 {
+				return fmt.Errorf("match rule on the method can't check its existence")
+			}
+		case MatchSourceHeader, MatchSourceQuery, MatchSourceBody:
+			if r.Key == "" {
+				return fmt.Errorf("match rule on the %s must have a key", r.Source)
+			}
+		default:
+			return fmt.Errorf("invalid match rule source: %q", r.Source)
+		}
+
+		set := 0
+		if r.Equals != "" {
+			set++
+		}
+		if r.Regex != "" {
+			set++
+		}
+		if r.Exists >= 1 {
+			set++
+		}
+		if set != 1 {
+			return fmt.Errorf("match rule must have exactly one of equals, regex or exists")
+		}
+		if r.Regex != "" && r.regex == nil {
+			// Compiled once and for all, the rule may be in use already
+			regex, err := regexp.Compile(r.Regex)
+			if err != nil {
+				return fmt.Errorf("match rule has an invalid regex: %w", err)
+			}
+			r.regex = regex
+		}
+	}
+	return nil
+}
+
+// SkipReason returns why the call doesn't match the rules, an empty string if it does
+func (rules MatchRules) SkipReason(request *http.Request, body []byte) string {
+	for _, r := range rules {
+		if r.matches(request, body) == (r.Negate >= 1) {
+			return fmt.Sprintf("no match: %s", r)
+		}
+	}
+	return ""
+}
+
+func (r *MatchRule) matches(request *http.Request, body []byte) bool {
+	var values []string
+	switch r.Source {
+	case MatchSourceMethod:
+		return (r.Equals != "" && strings.EqualFold(request.Method, r.Equals)) || (r.Regex != "" && r.compiled().MatchString(request.Method))
+	case MatchSourceHeader:
+		values = request.Header.Values(r.Key)
+	case MatchSourceQuery:
+		values = request.URL.Query()[r.Key]
+	case MatchSourceBody:
+		if result := gjson.GetBytes(body, r.Key); result.Exists() {
+			values = []string{result.String()}
+		}
+	}
+
+	if r.Exists >= 1 {
+		return len(values) > 0
+	}
+	for _, v := range values {
+		if (r.Equals != "" && v == r.Equals) || (r.Regex != "" && r.compiled().MatchString(v)) {
+			return true
+		}
+	}
+	return false
+}
+
+// compiled returns the regex compiled by Verify, or compiles it now for a rule that hasn't been verified
+func (r *MatchRule) compiled() *regexp.Regexp {
+	if r.regex != nil {
+		return r.regex
+	}
+	regex, err := regexp.Compile(r.Regex)
+	if err != nil {
+		return regexp.MustCompile(`$^`) // matches nothing
+	}
+	return regex
+}
+
+func (r *MatchRule) String() string {
+	subject := r.Source
+	if r.Source != MatchSourceMethod {
+		subject = fmt.Sprintf("%s %q", r.Source, r.Key)
+	}
+	negate := ""
+	if r.Negate >= 1 {
+		negate = "not "
+	}
+	switch {
+	case r.Exists >= 1:
+		return fmt.Sprintf("%s must %sexist", subject, negate)
+	case r.Regex != "":
+		return fmt.Sprintf("%s must %smatch /%s/", subject, negate, r.Regex)
+	default:
+		return fmt.Sprintf("%s must %sequal %q", subject, negate, r.Equals)
+	}
+}
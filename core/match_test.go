@@ -0,0 +1,71 @@
+package core
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMatchRulesSkipReason(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules MatchRules
+		skip  bool
+	}{
+		{"no rules", nil, false},
+		{"method", MatchRules{{Source: MatchSourceMethod, Equals: "post"}}, false},
+		{"method regex", MatchRules{{Source: MatchSourceMethod, Regex: "^(PUT|PATCH)$"}}, true},
+		{"header", MatchRules{{Source: MatchSourceHeader, Key: "X-Event", Equals: "order.created"}}, false},
+		{"header regex", MatchRules{{Source: MatchSourceHeader, Key: "X-Event", Regex: `^order\.`}}, false},
+		{"query exists", MatchRules{{Source: MatchSourceQuery, Key: "test", Exists: 1}}, false},
+		{"query negated", MatchRules{{Source: MatchSourceQuery, Key: "test", Exists: 1, Negate: 1}}, true},
+		{"body", MatchRules{{Source: MatchSourceBody, Key: "data.amount", Equals: "42"}}, false},
+		{"body missing", MatchRules{{Source: MatchSourceBody, Key: "data.currency", Exists: 1}}, true},
+		{"all must match", MatchRules{
+			{Source: MatchSourceMethod, Equals: "POST"},
+			{Source: MatchSourceHeader, Key: "X-Event", Equals: "order.deleted"},
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rules.Verify(); err != nil {
+				t.Fatal(err)
+			}
+			request := httptest.NewRequest("POST", "/hooks?test=1", nil)
+			request.Header.Set("X-Event", "order.created")
+			reason := tt.rules.SkipReason(request, []byte(`{"data":{"amount":42}}`))
+			if (reason != "") != tt.skip {
+				t.Errorf("SkipReason = %q, want skipped = %v", reason, tt.skip)
+			}
+		})
+	}
+}
+
+func TestMatchRulesVerifyInUse(t *testing.T) {
+	rules := MatchRules{{Source: MatchSourceHeader, Key: "X-Event", Regex: `^order\.`}}
+	if err := rules.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verified again while in use, as when its Webhook is registered again: -race would tell if it changed the rules
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := rules.Verify(); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			request := httptest.NewRequest("POST", "/hooks", strings.NewReader(""))
+			request.Header.Set("X-Event", "order.created")
+			if reason := rules.SkipReason(request, nil); reason != "" {
+				t.Error(reason)
+			}
+		}()
+	}
+	wg.Wait()
+}
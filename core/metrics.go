@@ -0,0 +1,206 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/eliezedeck/gobase/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+const metricsNamespace = "webhook_ingestor"
+
+var (
+	metricRequestsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_received_total",
+		Help:      "Calls received by the Webhooks.",
+	}, []string{"webhook_id"})
+	metricBytesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_bytes_received_total",
+		Help:      "Size of the bodies received by the Webhooks.",
+	}, []string{"webhook_id"})
+	metricRequestsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_rejected_total",
+		Help:      "Calls refused by the Webhooks, by reason.",
+	}, []string{"webhook_id", "reason"})
+
+	metricForwardAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "forward_attempts_total",
+		Help:      "Forwards made to the Forward URLs, by outcome: the status class (2xx, 3xx, 4xx, 5xx) or error.",
+	}, []string{"webhook_id", "forward_url_id", "outcome"})
+	metricForwardDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "forward_duration_seconds",
+		Help:      "Latency of the forwards, until the response has been fully read.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"webhook_id", "forward_url_id"})
+
+	metricCircuitState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "circuit_breaker_state",
+		Help:      "State of the circuit breakers of the Forward URLs: 0 closed, 1 half-open, 2 open.",
+	}, []string{"webhook_id", "forward_url_id"})
+	metricCircuitShortCircuits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "circuit_breaker_short_circuits_total",
+		Help:      "Forwards that were not made because the circuit breaker was open.",
+	}, []string{"webhook_id", "forward_url_id"})
+
+	metricForwardsQueued = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "forwards_queued_total",
+		Help:      "Forwards that were left to the delivery workers because of the rate limit of the Forward URL.",
+	}, []string{"webhook_id", "forward_url_id"})
+
+	metricStorageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "storage_write_duration_seconds",
+		Help:      "Latency of the writes to the requests storage, by operation.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"operation"})
+	metricStorageErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "storage_write_errors_total",
+		Help:      "Failed writes to the requests storage, by operation.",
+	}, []string{"operation"})
+)
+
+// observeForward records the outcome of a single forward
+func observeForward(attempt *DeliveryAttempt) {
+	outcome := "error"
+	if attempt.Error == "" {
+		outcome = fmt.Sprintf("%dxx", attempt.StatusCode/100)
+	}
+	metricForwardAttempts.WithLabelValues(attempt.WebhookId, attempt.ForwardUrlId, outcome).Inc()
+	metricForwardDuration.WithLabelValues(attempt.WebhookId, attempt.ForwardUrlId).Observe(attempt.Latency.Seconds())
+}
+
+// observeCircuitBreaker records the state of a circuit breaker whenever it changes
+func observeCircuitBreaker(state *CircuitBreakerState) {
+	value := 0.0
+	switch state.State {
+	case CircuitStateHalfOpen:
+		value = 1
+	case CircuitStateOpen:
+		value = 2
+	}
+	metricCircuitState.WithLabelValues(state.WebhookId, state.ForwardUrlId).Set(value)
+}
+
+// instrumentedStorage measures the writes made to the RequestsStorage it wraps, the reads go straight through
+type instrumentedStorage struct {
+	RequestsStorage
+}
+
+// InstrumentRequestsStorage returns a RequestsStorage that exposes the metrics of the given one. The number of
+// pending Requests is also exposed, it is counted by the storage whenever the metrics are collected.
+func InstrumentRequestsStorage(storage RequestsStorage) RequestsStorage {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "pending_requests",
+		Help:      "Requests that are waiting to be delivered, including the ones being retried.",
+	}, func() float64 {
+		count, err := storage.CountPendingRequests()
+		if err != nil {
+			logging.L.Error("Error counting the pending requests", zap.Error(err))
+			return math.NaN()
+		}
+		return float64(count)
+	})
+	return &instrumentedStorage{RequestsStorage: storage}
+}
+
+func (s *instrumentedStorage) ExpiresRequests() bool {
+	return expiresRequests(s.RequestsStorage)
+}
+
+func observeStorage(operation string, start time.Time, err error) {
+	metricStorageDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metricStorageErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+func (s *instrumentedStorage) StoreRequest(request *Request) error {
+	start := time.Now()
+	err := s.RequestsStorage.StoreRequest(request)
+	observeStorage("storeRequest", start, err)
+	return err
+}
+
+func (s *instrumentedStorage) UpdateRequest(request *Request) error {
+	start := time.Now()
+	err := s.RequestsStorage.UpdateRequest(request)
+	observeStorage("updateRequest", start, err)
+	return err
+}
+
+func (s *instrumentedStorage) DeleteRequest(id string) error {
+	start := time.Now()
+	err := s.RequestsStorage.DeleteRequest(id)
+	observeStorage("deleteRequest", start, err)
+	return err
+}
+
+func (s *instrumentedStorage) ClaimPendingRequests(now time.Time, lease time.Duration, count int) ([]*Request, error) {
+	start := time.Now()
+	requests, err := s.RequestsStorage.ClaimPendingRequests(now, lease, count)
+	observeStorage("claimPendingRequests", start, err)
+	return requests, err
+}
+
+func (s *instrumentedStorage) MoveToDeadLetters(request *Request) error {
+	start := time.Now()
+	err := s.RequestsStorage.MoveToDeadLetters(request)
+	observeStorage("moveToDeadLetters", start, err)
+	return err
+}
+
+func (s *instrumentedStorage) StoreDeliveryAttempt(attempt *DeliveryAttempt) error {
+	start := time.Now()
+	err := s.RequestsStorage.StoreDeliveryAttempt(attempt)
+	observeStorage("storeDeliveryAttempt", start, err)
+	return err
+}
+
+func (s *instrumentedStorage) ClaimIdempotencyKey(record *IdempotencyRecord, now time.Time) (*IdempotencyRecord, error) {
+	start := time.Now()
+	original, err := s.RequestsStorage.ClaimIdempotencyKey(record, now)
+	observeStorage("claimIdempotencyKey", start, err)
+	return original, err
+}
+
+func (s *instrumentedStorage) CompleteIdempotencyKey(record *IdempotencyRecord) error {
+	start := time.Now()
+	err := s.RequestsStorage.CompleteIdempotencyKey(record)
+	observeStorage("completeIdempotencyKey", start, err)
+	return err
+}
+
+func (s *instrumentedStorage) ReleaseIdempotencyKey(record *IdempotencyRecord) error {
+	start := time.Now()
+	err := s.RequestsStorage.ReleaseIdempotencyKey(record)
+	observeStorage("releaseIdempotencyKey", start, err)
+	return err
+}
+
+func (s *instrumentedStorage) PurgeExpiredRequests(now time.Time) (int, error) {
+	start := time.Now()
+	purged, err := s.RequestsStorage.PurgeExpiredRequests(now)
+	observeStorage("purgeExpiredRequests", start, err)
+	return purged, err
+}
+
+func (s *instrumentedStorage) TrimRequests(webhookId string, keep int) (int, error) {
+	start := time.Now()
+	trimmed, err := s.RequestsStorage.TrimRequests(webhookId, keep)
+	observeStorage("trimRequests", start, err)
+	return trimmed, err
+}
@@ -0,0 +1,138 @@
+package core
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// RequestQuery selects stored Requests, one page at a time. The zero value of each filter matches everything.
+type RequestQuery struct {
+	WebhookId    string
+	ForwardUrlId string
+	Method       string
+	PathPrefix   string
+	// Since is inclusive, Until is exclusive
+	Since time.Time
+	Until time.Time
+	// Header, when set, must have HeaderValue among its values
+	Header      string
+	HeaderValue string
+	Status      string
+
+	NewestFirst bool
+	// After is the position of the last Request of the previous page, if any
+	After *RequestCursor
+	Limit int
+}
+
+// RequestCursor is a position in the (CreatedAt, ID) ordering of the Requests
+type RequestCursor struct {
+	CreatedAt   time.Time `json:"t"`
+	ID          string    `json:"id"`
+	NewestFirst bool      `json:"n"`
+}
+
+// Encode turns the cursor into an opaque string for the API
+func (c *RequestCursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func DecodeRequestCursor(s string) (*RequestCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	cursor := &RequestCursor{}
+	if err := json.Unmarshal(data, cursor); err != nil || cursor.ID == "" {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return cursor, nil
+}
+
+// CanonicalHeader returns the Header name the way it is stored in the Request headers
+func (q *RequestQuery) CanonicalHeader() string {
+	return textproto.CanonicalMIMEHeaderKey(q.Header)
+}
+
+// Matches tells if the Request passes all the filters and comes after the cursor. This is meant for the storages that
+// can't do the filtering themselves.
+func (q *RequestQuery) Matches(r *Request) bool {
+	if q.WebhookId != "" && r.FromWebhookId != q.WebhookId {
+		return false
+	}
+	if q.ForwardUrlId != "" && (r.ForwardUrl == nil || r.ForwardUrl.ID != q.ForwardUrlId) {
+		return false
+	}
+	if q.Method != "" && r.Method != q.Method {
+		return false
+	}
+	if q.PathPrefix != "" && !strings.HasPrefix(r.Path, q.PathPrefix) {
+		return false
+	}
+	if !q.Since.IsZero() && r.CreatedAt.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !r.CreatedAt.Before(q.Until) {
+		return false
+	}
+	if q.Header != "" {
+		found := false
+		for _, v := range r.Headers[q.CanonicalHeader()] {
+			if v == q.HeaderValue {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.Status != "" && r.Status != q.Status {
+		return false
+	}
+	if q.After != nil {
+		return q.Less(q.After.CreatedAt, q.After.ID, r.CreatedAt, r.ID)
+	}
+	return true
+}
+
+// Less tells if the Request at (t1, id1) comes before the one at (t2, id2) in the order of the query
+func (q *RequestQuery) Less(t1 time.Time, id1 string, t2 time.Time, id2 string) bool {
+	if q.NewestFirst {
+		t1, id1, t2, id2 = t2, id2, t1, id1
+	}
+	if t1.Equal(t2) {
+		return id1 < id2
+	}
+	return t1.Before(t2)
+}
+
+// RequestPage is a page of Requests, NextCursor is empty on the last page
+type RequestPage struct {
+	Requests   []*Request `json:"requests"`
+	NextCursor string     `json:"nextCursor"`
+}
+
+// queryRequests gets a page of Requests, the next cursor is only given if the page is full
+func queryRequests(reqStore RequestsStorage, query *RequestQuery) (*RequestPage, error) {
+	requests, err := reqStore.QueryRequests(query)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &RequestPage{Requests: requests}
+	if len(requests) > 0 && len(requests) == query.Limit {
+		last := requests[len(requests)-1]
+		page.NextCursor = (&RequestCursor{
+			CreatedAt:   last.CreatedAt,
+			ID:          last.ID,
+			NewestFirst: query.NewestFirst,
+		}).Encode()
+	}
+	return page, nil
+}
@@ -0,0 +1,26 @@
+package core
+
+import (
+	"crypto/rand"
+)
+
+const idLetters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// RandomString returns `n` random letters, for the IDs. Unlike gobase's random.String, it is safe for concurrent use.
+func RandomString(n int) string {
+	b := make([]byte, n)
+	buf := make([]byte, n+n/2)
+	for i := 0; i < n; {
+		if _, err := rand.Read(buf); err != nil {
+			panic(err) // the system's randomness is broken
+		}
+		for _, r := range buf {
+			// Masked to 6 bits, only the indexes within the letters are kept so that they are all as likely
+			if idx := int(r & 63); idx < len(idLetters) && i < n {
+				b[i] = idLetters[idx]
+				i++
+			}
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,154 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// forwardQueueDelay is when a queued Request is tried again, if it is held back by the concurrency cap
+const forwardQueueDelay = deliveryPollInterval
+
+// ErrForwardQueued is returned instead of forwarding when the ForwardRateLimit has been reached, the Request is left
+// pending for the delivery workers
+var ErrForwardQueued = errors.New("forward rate limit has been reached, request is queued")
+
+// ForwardRateLimit protects a ForwardUrl from the bursts of the providers. The forwards that the Webhook caller waits
+// for wait for their turn, within their Timeout; the others are queued in the storage and made by the delivery workers.
+// It is not stored directly in the database but as a child/nested object of the ForwardUrl.
+//
+// The limits apply to each instance separately.
+type ForwardRateLimit struct {
+	// RequestsPerSecond is the rate of the token bucket, 0 is unlimited
+	RequestsPerSecond float64 `bson:"requestsPerSecond"  json:"requestsPerSecond"`
+	// Burst is the size of the token bucket, defaults to the RequestsPerSecond rounded up
+	Burst int `bson:"burst"  json:"burst"`
+	// MaxConcurrent is the maximum number of forwards in flight, 0 is unlimited
+	MaxConcurrent int `bson:"maxConcurrent"  json:"maxConcurrent"`
+}
+
+func (l *ForwardRateLimit) Verify() error {
+	if l.RequestsPerSecond < 0 || l.Burst < 0 || l.MaxConcurrent < 0 {
+		return fmt.Errorf("forward rate limit must not be negative")
+	}
+	if l.RequestsPerSecond == 0 && l.MaxConcurrent == 0 {
+		return fmt.Errorf("forward rate limit must have a rate or a max concurrency")
+	}
+	return nil
+}
+
+type forwardLimiter struct {
+	policy ForwardRateLimit
+	tokens *rate.Limiter
+	// slots holds a value for each forward in flight, nil if there is no concurrency cap
+	slots chan struct{}
+}
+
+var (
+	// forwardLimiters are by Webhook ID and ForwardUrl ID, they are created on the first forward
+	forwardLimiters   = make(map[string]*forwardLimiter)
+	forwardLimitersMu = &sync.Mutex{}
+)
+
+// forwardLimiterFor returns the limiter of the ForwardUrl, nil if it doesn't have any. A new limiter replaces the
+// previous one whenever the ForwardRateLimit changes.
+func forwardLimiterFor(webhookId string, furl *ForwardUrl) *forwardLimiter {
+	if furl.RateLimit == nil {
+		return nil
+	}
+
+	forwardLimitersMu.Lock()
+	defer forwardLimitersMu.Unlock()
+
+	key := webhookId + "/" + furl.ID
+	if l, found := forwardLimiters[key]; found && l.policy == *furl.RateLimit {
+		return l
+	}
+
+	l := &forwardLimiter{policy: *furl.RateLimit, tokens: rate.NewLimiter(rate.Inf, 0)}
+	if l.policy.RequestsPerSecond > 0 {
+		burst := l.policy.Burst
+		if burst < 1 {
+			burst = int(math.Ceil(l.policy.RequestsPerSecond))
+		}
+		l.tokens = rate.NewLimiter(rate.Limit(l.policy.RequestsPerSecond), burst)
+	}
+	if l.policy.MaxConcurrent >= 1 {
+		l.slots = make(chan struct{}, l.policy.MaxConcurrent)
+	}
+	forwardLimiters[key] = l
+	return l
+}
+
+// wait blocks until the forward can be made, or until the context is done
+func (l *forwardLimiter) wait(ctx context.Context) (func(), error) {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if err := l.tokens.Wait(ctx); err != nil {
+		l.release()
+		return nil, err
+	}
+	return l.release, nil
+}
+
+// try returns right away, it tells when to try again if the forward can't be made at `now`
+func (l *forwardLimiter) try(now time.Time) (func(), time.Time, bool) {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			return nil, now.Add(forwardQueueDelay), false
+		}
+	}
+	reservation := l.tokens.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); !reservation.OK() || delay > 0 {
+		reservation.CancelAt(now)
+		l.release()
+		return nil, now.Add(delay), false
+	}
+	return l.release, time.Time{}, true
+}
+
+func (l *forwardLimiter) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// throttleForward takes the turn of the Request for its ForwardUrl, the returned func must be called once the forward
+// is over. When the turn can't be taken, either right away or within the context if `wait` is set, ErrForwardQueued is
+// returned and the Request is due when it is to be tried again.
+func throttleForward(ctx context.Context, request *Request, wait bool) (func(), error) {
+	furl := request.forwardUrl()
+	l := forwardLimiterFor(request.FromWebhookId, furl)
+	if l == nil {
+		return func() {}, nil
+	}
+
+	now := time.Now()
+	if wait {
+		release, err := l.wait(ctx)
+		if err == nil {
+			return release, nil
+		}
+		request.NextAttemptAt = now
+	} else {
+		release, retryAt, ok := l.try(now)
+		if ok {
+			return release, nil
+		}
+		request.NextAttemptAt = retryAt
+	}
+	metricForwardsQueued.WithLabelValues(request.FromWebhookId, furl.ID).Inc()
+	return nil, ErrForwardQueued
+}
@@ -2,15 +2,61 @@ package core
 
 import "time"
 
+const (
+	// RequestStatusPending is for a Request that is still to be delivered to its ForwardUrl
+	RequestStatusPending = "pending"
+	// RequestStatusDelivered is for a Request that has been kept after a successful delivery
+	RequestStatusDelivered = "delivered"
+	// RequestStatusDeadLetter is for a Request that has run out of retries, it is moved to the dead letters
+	RequestStatusDeadLetter = "deadLetter"
+	// RequestStatusRejected is for a Request that has been refused by the Webhook, only kept for auditing
+	RequestStatusRejected = "rejected"
+	// RequestStatusSkipped is for a Request that didn't match the rules of its ForwardUrl, it is never delivered
+	RequestStatusSkipped = "skipped"
+)
+
+// Request is a call to a Webhook, one for each of its ForwardUrls. The Body is kept byte for byte, it is given as text
+// in JSON if it is valid UTF-8 and base64 encoded otherwise, see MarshalJSON.
 type Request struct {
 	ID            string              `bson:"_id"            json:"id"`
 	Method        string              `bson:"method"         json:"method"`
 	Path          string              `bson:"path"           json:"path"`
+	Query         string              `bson:"query"          json:"query"`
 	Headers       map[string][]string `bson:"headers"        json:"headers"`
-	Body          string              `bson:"body"           json:"body"`
+	Body          []byte              `bson:"body"           json:"-"`
 	ForwardUrl    *ForwardUrl         `bson:"forwardUrl"     json:"forwardUrl"`
 	FromWebhookId string              `bson:"fromWebhookId"  json:"fromWebhookId"`
 	CreatedAt     time.Time           `bson:"createdAt"      json:"createdAt"`
 
+	// Delivery state, only relevant when there is a ForwardUrl
+	Status        string     `bson:"status"         json:"status"`
+	NextAttemptAt time.Time  `bson:"nextAttemptAt"  json:"nextAttemptAt"`
+	LockedUntil   time.Time  `bson:"lockedUntil"    json:"lockedUntil"`
+	Attempts      []*Attempt `bson:"attempts"       json:"attempts"`
+
+	// ExpiresAt is when the Request is to be purged, as per the RetentionPolicy; never if zero
+	ExpiresAt time.Time `bson:"expiresAt,omitempty" json:"expiresAt"`
+
+	// Rejection is the reason why the Request has been refused or skipped, or dead lettered without being attempted
+	Rejection string `bson:"rejection,omitempty" json:"rejection,omitempty"`
+
 	ReplayPayload *Replay `bson:"replayPayload" json:"replayPayload"`
+
+	// BodyBlob is the ID of the spooled body in the BlobStorage, the Body is empty then; empty if the Body is inline
+	BodyBlob string `bson:"bodyBlob,omitempty" json:"bodyBlob,omitempty"`
+	BodySize int64  `bson:"bodySize"           json:"bodySize"`
+	// ContentEncoding of the Body (e.g. gzip), as per the Content-Encoding of the call; empty if it isn't encoded
+	ContentEncoding string `bson:"contentEncoding,omitempty" json:"contentEncoding,omitempty"`
+
+	// forward is the ForwardUrl as it is configured right now, with its secrets, which is used to forward the Request.
+	// It is never stored: the ForwardUrl above is only a copy without the secrets, for the record.
+	forward *ForwardUrl
+}
+
+// Attempt is the outcome of a single forward of a Request. It is not stored directly in the database but as a
+// child/nested object.
+type Attempt struct {
+	At         time.Time `bson:"at"          json:"at"`
+	StatusCode int       `bson:"statusCode"  json:"statusCode"`
+	Error      string    `bson:"error"       json:"error"`
 }
@@ -0,0 +1,190 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/eliezedeck/gobase/logging"
+	"go.uber.org/zap"
+)
+
+// RetentionPolicy limits how long the stored Requests of a Webhook are kept. Pending Requests are never purged. It is
+// not stored directly in the database but as a child/nested object of the Webhook.
+type RetentionPolicy struct {
+	// MaxAge of the delivered and the plainly stored Requests, 0 keeps them forever
+	MaxAge Duration `bson:"maxAge"  json:"maxAge"`
+	// MaxCount of stored Requests per Webhook, the oldest are purged first, 0 is unlimited
+	MaxCount int `bson:"maxCount"  json:"maxCount"`
+	// FailedMaxAge of the dead letters and rejected Requests, so that they can be kept longer, 0 keeps them forever
+	FailedMaxAge Duration `bson:"failedMaxAge"  json:"failedMaxAge"`
+}
+
+func (p *RetentionPolicy) Verify() error {
+	if p.MaxAge < 0 || p.FailedMaxAge < 0 {
+		return fmt.Errorf("retention policy ages must not be negative")
+	}
+	if p.MaxCount < 0 {
+		return fmt.Errorf("retention policy max count must not be negative")
+	}
+	return nil
+}
+
+// expiresAt returns when a Request with the given status, settled at `now`, expires. The zero time means never.
+func (p *RetentionPolicy) expiresAt(status string, now time.Time) time.Time {
+	if p == nil {
+		return time.Time{}
+	}
+	maxAge := p.MaxAge
+	switch status {
+	case RequestStatusPending:
+		return time.Time{}
+	case RequestStatusDeadLetter, RequestStatusRejected:
+		maxAge = p.FailedMaxAge
+	}
+	if maxAge <= 0 {
+		return time.Time{}
+	}
+	return now.Add(time.Duration(maxAge))
+}
+
+// attemptExpiresAt returns when a DeliveryAttempt started at `now` expires, so that it lives about as long as its
+// Request whatever the outcome. The zero time means never.
+func (p *RetentionPolicy) attemptExpiresAt(now time.Time) time.Time {
+	if p == nil || p.MaxAge <= 0 || p.FailedMaxAge <= 0 {
+		return time.Time{}
+	}
+	maxAge := p.MaxAge
+	if p.FailedMaxAge > maxAge {
+		maxAge = p.FailedMaxAge
+	}
+	return now.Add(time.Duration(maxAge))
+}
+
+var (
+	// DefaultRetention applies to the Webhooks that don't have their own RetentionPolicy
+	DefaultRetention *RetentionPolicy
+)
+
+// retentionFor returns the RetentionPolicy of the registered Webhook, or the DefaultRetention
+func retentionFor(webhookId string) *RetentionPolicy {
+	if w := registeredWebhook(webhookId); w != nil && w.Retention != nil {
+		return w.Retention
+	}
+	return DefaultRetention
+}
+
+// RetentionReport is what a single run of the retention janitor has purged
+type RetentionReport struct {
+	RanAt   time.Time `json:"ranAt"`
+	Expired int       `json:"expired"`
+	// ExpiredByStorage tells that the storage deletes the expired Requests by itself, they are not counted in Expired
+	ExpiredByStorage bool `json:"expiredByStorage"`
+	// Trimmed is the number of Requests purged because of the MaxCount, by Webhook ID
+	Trimmed map[string]int `json:"trimmed"`
+	// Blobs is the number of spooled bodies deleted, their Requests being gone
+	Blobs  int      `json:"blobs"`
+	Errors []string `json:"errors"`
+}
+
+const retentionReportsKept = 50
+
+var (
+	retentionReports   = make([]*RetentionReport, 0, retentionReportsKept)
+	retentionReportsMu = &sync.Mutex{}
+)
+
+// StartRetentionJanitor purges, every `interval`, the Requests that have expired or that exceed the MaxCount of their
+// Webhook. Storages that expire the Requests by themselves (like MongoDB with its TTL index) only need the latter. An
+// interval of 0 disables the janitor.
+func StartRetentionJanitor(config ConfigStorage, reqStore RequestsStorage, interval time.Duration) {
+	if interval <= 0 {
+		logging.L.Info("Retention janitor is disabled")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			runRetention(config, reqStore)
+		}
+	}()
+	logging.L.Info("Retention janitor started", zap.Duration("interval", interval))
+}
+
+func runRetention(config ConfigStorage, reqStore RequestsStorage) *RetentionReport {
+	report := &RetentionReport{
+		RanAt:   time.Now(),
+		Trimmed: make(map[string]int),
+	}
+
+	expired, err := reqStore.PurgeExpiredRequests(report.RanAt)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	report.Expired = expired
+	report.ExpiredByStorage = expiresRequests(reqStore)
+
+	webhooks, err := config.GetAllWebhooks()
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	for _, w := range webhooks {
+		policy := w.Retention
+		if policy == nil {
+			policy = DefaultRetention
+		}
+		if policy == nil || policy.MaxCount <= 0 {
+			continue
+		}
+		trimmed, err := reqStore.TrimRequests(w.ID, policy.MaxCount)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+		if trimmed > 0 {
+			report.Trimmed[w.ID] = trimmed
+		}
+	}
+
+	// The spooled bodies are swept last, once their Requests have been purged
+	blobs, err := sweepBlobs(reqStore, report.RanAt)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	report.Blobs = blobs
+
+	if len(report.Errors) > 0 {
+		logging.L.Error("Retention run has errors", zap.Strings("errors", report.Errors))
+	}
+	if report.Expired > 0 || len(report.Trimmed) > 0 {
+		logging.L.Info("Retention run has purged requests", zap.Int("expired", report.Expired), zap.Any("trimmed", report.Trimmed))
+	}
+
+	retentionReportsMu.Lock()
+	if len(retentionReports) == retentionReportsKept {
+		retentionReports = retentionReports[1:]
+	}
+	retentionReports = append(retentionReports, report)
+	retentionReportsMu.Unlock()
+	return report
+}
+
+// expiresRequests tells if the storage deletes the expired Requests by itself
+func expiresRequests(storage RequestsStorage) bool {
+	s, ok := storage.(SelfExpiringStorage)
+	return ok && s.ExpiresRequests()
+}
+
+// getRetentionReports returns the latest reports, newest first
+func getRetentionReports() []*RetentionReport {
+	retentionReportsMu.Lock()
+	defer retentionReportsMu.Unlock()
+
+	reports := make([]*RetentionReport, 0, len(retentionReports))
+	for i := len(retentionReports) - 1; i >= 0; i-- {
+		reports = append(reports, retentionReports[i])
+	}
+	return reports
+}
@@ -0,0 +1,78 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy tells the delivery worker how a failed forward to a ForwardUrl is to be retried. It is not stored
+// directly in the database but as a child/nested object of the ForwardUrl.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the very first one made by the Webhook handler
+	MaxAttempts int      `bson:"maxAttempts"  json:"maxAttempts"`
+	BaseDelay   Duration `bson:"baseDelay"    json:"baseDelay"`
+	MaxDelay    Duration `bson:"maxDelay"     json:"maxDelay"`
+	// Jitter is the fraction (0 to 1) of the computed delay that is randomly added or removed
+	Jitter float64 `bson:"jitter"  json:"jitter"`
+	// RetryableStatusCodes defaults to 408, 429 and all 5xx when empty
+	RetryableStatusCodes []int `bson:"retryableStatusCodes"  json:"retryableStatusCodes"`
+}
+
+func (p *RetryPolicy) Verify() error {
+	if p.MaxAttempts < 1 {
+		return fmt.Errorf("retry policy must have at least 1 attempt")
+	}
+	if p.BaseDelay <= 0 {
+		return fmt.Errorf("retry policy must have a positive base delay")
+	}
+	if p.MaxDelay != 0 && p.MaxDelay < p.BaseDelay {
+		return fmt.Errorf("retry policy max delay must not be less than the base delay")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("retry policy jitter must be between 0 and 1")
+	}
+	for _, code := range p.RetryableStatusCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("retry policy has an invalid status code: %d", code)
+		}
+	}
+	return nil
+}
+
+// IsRetryableStatus tells if the given status code from the forwarded host is to be considered a failure. A nil
+// policy uses the default set of status codes.
+func (p *RetryPolicy) IsRetryableStatus(code int) bool {
+	if p == nil || len(p.RetryableStatusCodes) == 0 {
+		return code >= 500 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
+	}
+	for _, c := range p.RetryableStatusCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// CanRetry tells if another attempt can be made after `attempts` have already been made. A nil policy never retries.
+func (p *RetryPolicy) CanRetry(attempts int) bool {
+	return p != nil && attempts < p.MaxAttempts
+}
+
+// NextDelay returns how long to wait before the next attempt, after `attempts` have already been made. The delay
+// doubles on each attempt, is capped by MaxDelay then spread by the Jitter.
+func (p *RetryPolicy) NextDelay(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	delay := float64(p.BaseDelay) * math.Pow(2, math.Min(float64(attempts-1), 32))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(delay)
+}
@@ -0,0 +1,223 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/eliezedeck/gobase/logging"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// routedWebhookKey is where the matched Webhook is put on the context of the internal routes
+const routedWebhookKey = "routedWebhook"
+
+var (
+	// routedWebhooks are the enabled Webhooks that currently receive calls, by ID
+	routedWebhooks = make(map[string]*Webhook)
+	// routes only serves to match the calls against the routedWebhooks, it is rebuilt from scratch on each change so
+	// that it never has to be mutated while in use
+	routes   = echo.New()
+	routesMu = &sync.RWMutex{}
+)
+
+// SetupWebhookRouter makes the given Echo dispatch all the calls that don't match any of its own routes to the
+// registered Webhooks. Webhooks can then be registered, changed and unregistered at any time.
+func SetupWebhookRouter(e *echo.Echo, storage RequestsStorage) {
+	e.Any("/*", func(c echo.Context) error {
+		webhook := matchWebhook(c.Request())
+		if webhook == nil {
+			return c.String(http.StatusNotFound, "404 Not Found")
+		}
+		return webhook.serve(c, storage)
+	})
+}
+
+// matchWebhook returns the registered Webhook for the call, nil if there is none
+func matchWebhook(r *http.Request) *Webhook {
+	routesMu.RLock()
+	current := routes
+	routesMu.RUnlock()
+
+	c := current.NewContext(r, nil)
+	current.Router().Find(r.Method, echo.GetPath(r), c)
+	if err := c.Handler()(c); err != nil {
+		return nil // not found, or method not allowed
+	}
+	webhook, _ := c.Get(routedWebhookKey).(*Webhook)
+	return webhook
+}
+
+// RegisterWebhook starts routing the calls to the Webhook, or replaces its previous version with the same ID, which
+// may have had another Method or Path. A disabled Webhook is unregistered instead.
+func RegisterWebhook(w *Webhook) error {
+	return registerWebhooks([]*Webhook{w}, nil)
+}
+
+// registerWebhooks registers and unregisters the Webhooks all at once: if any of them can't be registered, nothing
+// changes
+func registerWebhooks(register []*Webhook, unregister []string) error {
+	for _, w := range register {
+		if err := w.Verify(); err != nil {
+			return err
+		}
+	}
+
+	routesMu.Lock()
+	defer routesMu.Unlock()
+
+	routed, err := routedWebhooksWith(register, unregister)
+	if err != nil {
+		return err
+	}
+	for id, w := range routedWebhooks {
+		if _, found := routed[id]; !found {
+			logging.L.Info("Webhook has been unregistered: {method} {path}",
+				zap.String("id", id),
+				zap.String("method", w.Method),
+				zap.String("path", w.Path))
+		}
+	}
+	routedWebhooks = routed
+	rebuildRoutes()
+	for _, w := range register {
+		if w.Enabled < 1 {
+			continue
+		}
+		logging.L.Info("Webhook has been registered: {method} {path} — {name}",
+			zap.String("id", w.ID),
+			zap.String("method", w.Method),
+			zap.String("path", w.Path),
+			zap.String("name", w.Name))
+	}
+	return nil
+}
+
+// checkWebhooks tells if the Webhooks could be registered, once the others are unregistered, without changing anything
+func checkWebhooks(register []*Webhook, unregister []string) error {
+	for _, w := range register {
+		if err := w.Verify(); err != nil {
+			return err
+		}
+	}
+
+	routesMu.RLock()
+	defer routesMu.RUnlock()
+
+	_, err := routedWebhooksWith(register, unregister)
+	return err
+}
+
+// routedWebhooksWith returns a copy of the routedWebhooks with the changes, or why they can't be made. It must be
+// called with the routesMu locked.
+func routedWebhooksWith(register []*Webhook, unregister []string) (map[string]*Webhook, error) {
+	routed := make(map[string]*Webhook, len(routedWebhooks)+len(register))
+	for id, w := range routedWebhooks {
+		routed[id] = w
+	}
+	for _, id := range unregister {
+		delete(routed, id)
+	}
+	for _, w := range register {
+		delete(routed, w.ID) // replaced, or unregistered when disabled
+	}
+	for _, w := range register {
+		if w.Enabled < 1 {
+			continue
+		}
+		for _, other := range routed {
+			if w.collidesWith(other) {
+				return nil, fmt.Errorf("webhook %s is already registered for %s %s", other.ID, other.Method, other.Path)
+			}
+		}
+		routed[w.ID] = w
+	}
+	return routed, nil
+}
+
+// collidesWith tells if both Webhooks, with different IDs, would receive the same calls
+func (w *Webhook) collidesWith(other *Webhook) bool {
+	if other.ID == w.ID || other.Path != w.Path {
+		return false
+	}
+	for _, method := range w.routedMethods() {
+		for _, otherMethod := range other.routedMethods() {
+			if method == otherMethod || method == "ANY" || otherMethod == "ANY" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// routedMethods returns the methods of the calls routed to the Webhook: its own Method, along with GET for the
+// handshakes that need it
+func (w *Webhook) routedMethods() []string {
+	methods := []string{w.Method}
+	if w.Method == "ANY" || w.Method == http.MethodGet {
+		return methods
+	}
+	for _, h := range w.Handshakes {
+		if h != nil && h.usesGet() {
+			return append(methods, http.MethodGet)
+		}
+	}
+	return methods
+}
+
+// receives tells if the calls with the given method are for the Webhook, rather than for its handshakes only
+func (w *Webhook) receives(method string) bool {
+	return w.Method == "ANY" || w.Method == method
+}
+
+// UnregisterWebhook stops routing the calls to the Webhook, the calls that are being handled are not interrupted
+func UnregisterWebhook(id string) {
+	routesMu.Lock()
+	defer routesMu.Unlock()
+
+	unregisterWebhook(id)
+}
+
+func unregisterWebhook(id string) {
+	w, found := routedWebhooks[id]
+	if !found {
+		return
+	}
+	delete(routedWebhooks, id)
+	rebuildRoutes()
+	logging.L.Info("Webhook has been unregistered: {method} {path}",
+		zap.String("id", id),
+		zap.String("method", w.Method),
+		zap.String("path", w.Path))
+}
+
+// rebuildRoutes must be called with the routesMu locked
+func rebuildRoutes() {
+	r := echo.New()
+	for _, w := range routedWebhooks {
+		webhook := w
+		handler := func(c echo.Context) error {
+			c.Set(routedWebhookKey, webhook)
+			return nil
+		}
+
+		// Support a special method called ANY, which will match any method
+		for _, method := range webhook.routedMethods() {
+			if method == "ANY" {
+				r.Any(webhook.Path, handler)
+			} else {
+				r.Add(method, webhook.Path, handler)
+			}
+		}
+	}
+	routes = r
+}
+
+// registeredWebhook returns the currently routed Webhook with the given ID, nil if there is none
+func registeredWebhook(id string) *Webhook {
+	routesMu.RLock()
+	defer routesMu.RUnlock()
+
+	return routedWebhooks[id]
+}
@@ -0,0 +1,58 @@
+package core
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutboundSigningSign(t *testing.T) {
+	// The reference example of the Standard Webhooks specification
+	const (
+		id      = "msg_p5jXN8AQM9LWM0D4loKWxJek"
+		payload = `{"test": 2432232314}`
+		secret  = "whsec_MfKQ9r8GKYqrTwjUPD8ILPZIo2LaLaSw"
+	)
+	timestamp := time.Unix(1614265330, 0)
+
+	tests := []struct {
+		name      string
+		secrets   []string
+		signature string
+	}{
+		{"specification", []string{secret}, "v1,g0hM9SsE+OTPJTGt/tmIKtSyZlE3uFJELVlNIOLJ1OE="},
+		// While rotating, there is a signature per secret; a secret without the prefix is used as is
+		{"rotation", []string{secret, "a-plain-secret"},
+			"v1,g0hM9SsE+OTPJTGt/tmIKtSyZlE3uFJELVlNIOLJ1OE= v1,o4qqOk9adunRQZethvXD0uyc/k974WOMFhNgC6IF0tw="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signing := &OutboundSigning{Secrets: tt.secrets}
+			if err := signing.Verify(); err != nil {
+				t.Fatal(err)
+			}
+			header := http.Header{}
+			if err := signing.Sign(header, id, strings.NewReader(payload), timestamp); err != nil {
+				t.Fatal(err)
+			}
+			if got := header.Get("webhook-id"); got != id {
+				t.Errorf("webhook-id = %s, want %s", got, id)
+			}
+			if got := header.Get("webhook-timestamp"); got != "1614265330" {
+				t.Errorf("webhook-timestamp = %s, want 1614265330", got)
+			}
+			if got := header.Get("webhook-signature"); got != tt.signature {
+				t.Errorf("webhook-signature = %s, want %s", got, tt.signature)
+			}
+		})
+	}
+}
+
+func TestOutboundSigningVerify(t *testing.T) {
+	for _, secrets := range [][]string{nil, {""}, {"whsec_not base64!"}} {
+		if err := (&OutboundSigning{Secrets: secrets}).Verify(); err == nil {
+			t.Errorf("Verify() of %q = nil, want an error", secrets)
+		}
+	}
+}
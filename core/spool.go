@@ -0,0 +1,228 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/eliezedeck/gobase/logging"
+	"go.uber.org/zap"
+)
+
+// blobGracePeriod is how long a blob is kept without a Request, the Request is only stored after its blob
+const blobGracePeriod = time.Hour
+
+// ErrBodyTooLarge is returned while reading a body that is larger than the max body size
+var ErrBodyTooLarge = errors.New("body is too large")
+
+var (
+	// MaxBodySize of the calls to the Webhooks that don't have their own, 0 is unlimited
+	MaxBodySize int64
+
+	// bodyBlobs is where the bodies larger than the spoolThreshold go, they are all kept in memory if nil
+	bodyBlobs      BlobStorage
+	spoolThreshold int64
+)
+
+// SetupBodySpool makes the bodies larger than `threshold` bytes go to the BlobStorage as they are read, instead of
+// being kept in memory and stored inline with their Request. They are streamed from there when forwarded.
+//
+// The features that look into the body (handshakes, body match rules, body transforms, deduplication on a body path)
+// only see the inline bodies: a spooled body is as good as empty to them. The signatures are computed on the spooled
+// bodies as well.
+func SetupBodySpool(blobs BlobStorage, threshold int64) {
+	bodyBlobs = blobs
+	spoolThreshold = threshold
+	logging.L.Info("Large bodies are spooled", zap.Int64("threshold", threshold))
+}
+
+// maxBodySize returns the max body size of the calls to the Webhook, its own or else the global one
+func (w *Webhook) maxBodySize() int64 {
+	if w.MaxBodySize > 0 {
+		return w.MaxBodySize
+	}
+	return MaxBodySize
+}
+
+// maxBodySizeFor returns the max body size of the registered Webhook, the global one if it is not registered
+func maxBodySizeFor(webhookId string) int64 {
+	if w := registeredWebhook(webhookId); w != nil {
+		return w.maxBodySize()
+	}
+	return MaxBodySize
+}
+
+// payload is the body of a call, either in memory or spooled to the BlobStorage
+type payload struct {
+	inline []byte
+	// content is the inline body as it is looked into, decompressed if it can be
+	content []byte
+	// blob is the ID of the spooled body, empty if it is inline
+	blob string
+	size int64
+	// sent is the inline body as it was sent, once it is stored decompressed; nil otherwise
+	sent []byte
+}
+
+// readPayload reads the whole body, which is spooled under the given ID if it is larger than the spoolThreshold.
+// ErrBodyTooLarge is returned as soon as the body exceeds the `limit`, 0 being unlimited.
+func readPayload(body io.Reader, id string, limit int64) (*payload, error) {
+	body = &limitedBody{body: body, limit: limit}
+	if bodyBlobs == nil {
+		inline, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		return &payload{inline: inline, content: inline, size: int64(len(inline))}, nil
+	}
+
+	head, err := io.ReadAll(io.LimitReader(body, spoolThreshold+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(head)) <= spoolThreshold {
+		return &payload{inline: head, content: head, size: int64(len(head))}, nil
+	}
+	size, err := bodyBlobs.StoreBlob(id, io.MultiReader(bytes.NewReader(head), body))
+	if err != nil {
+		return nil, err
+	}
+	return &payload{blob: id, size: size}, nil
+}
+
+// decompress makes the content of an inline body decompressed, it tells if it is. The spooled bodies are looked into
+// as they are.
+func (p *payload) decompress(coding string, limit int64) (bool, error) {
+	if p.blob != "" || coding == "" {
+		return false, nil
+	}
+	content, err := decompress(p.inline, coding, limit)
+	if err != nil {
+		return false, err
+	}
+	p.content = content
+	return true, nil
+}
+
+// keepDecompressed makes the decompressed content the body that is stored and forwarded
+func (p *payload) keepDecompressed() {
+	p.sent = p.inline
+	p.inline = p.content
+	p.size = int64(len(p.content))
+}
+
+func (p *payload) open() (io.ReadCloser, error) {
+	if p.blob == "" {
+		return io.NopCloser(bytes.NewReader(p.inline)), nil
+	}
+	return openBlob(p.blob)
+}
+
+// openSent opens the body as it was sent, even if it is stored decompressed
+func (p *payload) openSent() (io.ReadCloser, error) {
+	if p.sent != nil {
+		return io.NopCloser(bytes.NewReader(p.sent)), nil
+	}
+	return p.open()
+}
+
+// discard deletes the spooled body, if it is not kept by any Request
+func (p *payload) discard() {
+	if p.blob != "" {
+		deleteBlob(p.blob)
+	}
+}
+
+// limitedBody fails with ErrBodyTooLarge once more than `limit` bytes have been read, 0 being unlimited
+type limitedBody struct {
+	body  io.Reader
+	limit int64
+	read  int64
+}
+
+func (l *limitedBody) Read(b []byte) (int, error) {
+	n, err := l.body.Read(b)
+	l.read += int64(n)
+	if l.limit > 0 && l.read > l.limit {
+		return n, ErrBodyTooLarge
+	}
+	return n, err
+}
+
+func openBlob(id string) (io.ReadCloser, error) {
+	if bodyBlobs == nil {
+		return nil, fmt.Errorf("body %s is spooled, but there is no blob storage", id)
+	}
+	return bodyBlobs.OpenBlob(id)
+}
+
+// copyBlob gives a Request its own copy of the spooled body
+func copyBlob(from, to string) error {
+	blob, err := openBlob(from)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = blob.Close()
+	}()
+	_, err = bodyBlobs.StoreBlob(to, blob)
+	return err
+}
+
+func deleteBlob(id string) {
+	if bodyBlobs == nil {
+		return
+	}
+	if err := bodyBlobs.DeleteBlob(id); err != nil {
+		logging.L.Error("Error deleting spooled body", zap.Error(err), zap.String("id", id))
+	}
+}
+
+// openBody opens the body to forward: the spooled body of the Request, or else the transformed body. It must be closed
+// with closeBody, unless it is given to the http.Client.
+func (t *TransformedRequest) openBody(request *Request) (io.Reader, error) {
+	if request.BodyBlob == "" {
+		return bytes.NewReader(t.Body), nil
+	}
+	return openBlob(request.BodyBlob)
+}
+
+func closeBody(body io.Reader) {
+	if closer, ok := body.(io.Closer); ok {
+		_ = closer.Close()
+	}
+}
+
+// sweepBlobs deletes the blobs of the Requests and the dead letters that are gone, it returns how many it deleted
+func sweepBlobs(reqStore RequestsStorage, now time.Time) (int, error) {
+	if bodyBlobs == nil {
+		return 0, nil
+	}
+	ids, err := bodyBlobs.ListBlobs(now.Add(-blobGracePeriod))
+	if err != nil {
+		return 0, err
+	}
+
+	swept := 0
+	for _, id := range ids {
+		request, err := reqStore.GetRequest(id)
+		if err != nil {
+			return swept, err
+		}
+		if request == nil {
+			if request, err = reqStore.GetDeadLetter(id); err != nil {
+				return swept, err
+			}
+		}
+		if request != nil {
+			continue
+		}
+		if err := bodyBlobs.DeleteBlob(id); err != nil {
+			return swept, err
+		}
+		swept++
+	}
+	return swept, nil
+}
@@ -0,0 +1,99 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/eliezedeck/gobase/logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// tracer creates all the spans. Until SetupTracing is called, they are not recorded at all.
+var tracer = otel.Tracer("github.com/eliezedeck/webhook-ingestor")
+
+// propagator reads the trace context of the Webhook callers, and passes ours to the forwarded hosts (W3C traceparent)
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// TracingOptions tells where the spans are exported
+type TracingOptions struct {
+	// Exporter is either "otlp" or "stdout"; empty or "none" disables the tracing
+	Exporter string
+	// OtlpEndpoint is the host:port of the OTLP/HTTP collector, the OTEL_EXPORTER_OTLP_* environment variables apply
+	// when empty
+	OtlpEndpoint string
+	OtlpInsecure bool
+	// File is where the stdout exporter writes, the standard output when empty
+	File string
+}
+
+// SetupTracing installs the exporter of the spans. It is a no-op if the tracing is disabled.
+func SetupTracing(options TracingOptions) error {
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+	switch options.Exporter {
+	case "", "none":
+		return nil
+	case "otlp":
+		var opts []otlptracehttp.Option
+		if options.OtlpEndpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(options.OtlpEndpoint))
+		}
+		if options.OtlpInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	case "stdout":
+		var w io.Writer = os.Stdout
+		if options.File != "" {
+			if w, err = os.OpenFile(options.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+				return err
+			}
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(w))
+	default:
+		return fmt.Errorf("invalid tracing exporter %q, valid values are 'none', 'otlp' and 'stdout'", options.Exporter)
+	}
+	if err != nil {
+		return err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceNameKey.String("webhook-ingestor"))),
+	)
+	otel.SetTracerProvider(provider)
+	logging.L.Info("Tracing is enabled", zap.String("exporter", options.Exporter))
+	return nil
+}
+
+// endSpan records the error, if any, then ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceStorage runs a single operation on the storage in its own span
+func traceStorage(ctx context.Context, operation string, requestId string, fn func() error) error {
+	_, span := tracer.Start(ctx, operation, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("request.id", requestId)))
+	err := fn()
+	endSpan(span, err)
+	return err
+}
@@ -0,0 +1,251 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+
+	"github.com/tidwall/gjson"
+)
+
+// Transform reshapes a Request before it is forwarded to a ForwardUrl, the stored Request is left untouched. It is
+// not stored directly in the database but as a child/nested object of the ForwardUrl.
+//
+// The Url, the SetHeaders values and the BodyTemplate are Go templates. Their data is the incoming call: .Method,
+// .Path, .Query (raw) and .Headers, along with these functions:
+//   - query "name": first value of the query parameter
+//   - header "name": first value of the header
+//   - segment 0: a segment of the path, starting from 0
+//   - body "path": value of the JSON body at the gjson path, as text
+//   - bodyJSON "path": same, as JSON; null if there is none
+type Transform struct {
+	// Url replaces the URL of the ForwardUrl
+	Url string `bson:"url"  json:"url"`
+
+	// The headers are removed first, then renamed, then set
+	RemoveHeaders []string          `bson:"removeHeaders"  json:"removeHeaders"`
+	RenameHeaders map[string]string `bson:"renameHeaders"  json:"renameHeaders"`
+	SetHeaders    map[string]string `bson:"setHeaders"     json:"setHeaders"`
+
+	// Either BodyTemplate or BodyMapping replaces the body. BodyMapping builds a JSON object: each key is a dotted path
+	// in the new body, each value is the gjson path of the value in the incoming JSON body.
+	BodyTemplate string            `bson:"bodyTemplate"  json:"bodyTemplate"`
+	BodyMapping  map[string]string `bson:"bodyMapping"   json:"bodyMapping"`
+
+	url          *template.Template
+	headers      map[string]*template.Template
+	bodyTemplate *template.Template
+}
+
+// TransformPreview is the body of the administration's preview of a Transform
+type TransformPreview struct {
+	// The call to transform: either a stored Request, or an example given inline
+	RequestId string   `json:"requestId"`
+	Request   *Request `json:"request"`
+
+	// The Transform to apply: either the one of an existing Forward URL, or one given inline along with its URL
+	WebhookId    string     `json:"webhookId"`
+	ForwardUrlId string     `json:"forwardUrlId"`
+	Url          string     `json:"url"`
+	Transform    *Transform `json:"transform"`
+}
+
+// TransformedRequest is what is actually sent to the forwarded host
+type TransformedRequest struct {
+	Method  string      `json:"method"`
+	Url     string      `json:"url"`
+	Headers http.Header `json:"headers"`
+	Body    []byte      `json:"-"`
+}
+
+func (t *Transform) Verify() error {
+	if t.BodyTemplate != "" && len(t.BodyMapping) > 0 {
+		return fmt.Errorf("transform must not have both a body template and a body mapping")
+	}
+	for to, from := range t.BodyMapping {
+		if to == "" || from == "" {
+			return fmt.Errorf("transform body mapping must not have empty paths")
+		}
+	}
+	if t.headers != nil {
+		// Compiled once and for all, it may be in use already
+		return nil
+	}
+	return t.compile()
+}
+
+// compile parses the templates, it must not be called on a Transform that is in use
+func (t *Transform) compile() error {
+	var err error
+	if t.Url != "" {
+		if t.url, err = parseTemplate("url", t.Url); err != nil {
+			return err
+		}
+	}
+	t.headers = make(map[string]*template.Template, len(t.SetHeaders))
+	for name, value := range t.SetHeaders {
+		if t.headers[name], err = parseTemplate(name, value); err != nil {
+			return err
+		}
+	}
+	if t.BodyTemplate != "" {
+		if t.bodyTemplate, err = parseTemplate("body", t.BodyTemplate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	// The functions only serve for parsing here, the actual ones are bound to the Request when executing
+	tmpl, err := template.New(name).Option("missingkey=zero").Funcs(transformFuncs(&Request{})).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("transform has an invalid template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// transformData is the data of the templates
+type transformData struct {
+	Method  string
+	Path    string
+	Query   string
+	Headers map[string][]string
+}
+
+func transformFuncs(request *Request) template.FuncMap {
+	return template.FuncMap{
+		"query": func(name string) string {
+			values, _ := url.ParseQuery(request.Query)
+			return values.Get(name)
+		},
+		"header": func(name string) string {
+			return http.Header(request.Headers).Get(name)
+		},
+		"segment": func(i int) string {
+			segments := strings.Split(strings.Trim(request.Path, "/"), "/")
+			if i < 0 || i >= len(segments) {
+				return ""
+			}
+			return segments[i]
+		},
+		"body": func(path string) string {
+			return gjson.GetBytes(request.content(), path).String()
+		},
+		"bodyJSON": func(path string) string {
+			if result := gjson.GetBytes(request.content(), path); result.Exists() {
+				return result.Raw
+			}
+			return "null"
+		},
+	}
+}
+
+// Apply returns the Request as it is to be sent to the given URL. A nil Transform sends it as is, byte for byte. The
+// templates and the BodyMapping look into the body decompressed, the new body is not compressed.
+func (t *Transform) Apply(request *Request, forwardUrl string) (*TransformedRequest, error) {
+	result := &TransformedRequest{
+		Method:  request.Method,
+		Url:     forwardUrl,
+		Headers: http.Header{},
+		Body:    request.Body,
+	}
+	TransferHeaders(result.Headers, request.Headers)
+	if t == nil {
+		return result, nil
+	}
+	if t.headers == nil {
+		// Not verified yet, e.g. when it comes from a stored Request: the copy is compiled, the Transform may be shared
+		compiled := *t
+		if err := compiled.compile(); err != nil {
+			return nil, err
+		}
+		t = &compiled
+	}
+
+	data := &transformData{
+		Method:  request.Method,
+		Path:    request.Path,
+		Query:   request.Query,
+		Headers: request.Headers,
+	}
+	funcs := transformFuncs(request)
+	execute := func(tmpl *template.Template) (string, error) {
+		b := &bytes.Buffer{}
+		if err := template.Must(tmpl.Clone()).Funcs(funcs).Execute(b, data); err != nil {
+			return "", fmt.Errorf("transform of %s has failed: %w", tmpl.Name(), err)
+		}
+		return b.String(), nil
+	}
+
+	if t.url != nil {
+		u, err := execute(t.url)
+		if err != nil {
+			return nil, err
+		}
+		result.Url = u
+	}
+
+	for _, name := range t.RemoveHeaders {
+		result.Headers.Del(name)
+	}
+	for from, to := range t.RenameHeaders {
+		if values := result.Headers.Values(from); len(values) > 0 {
+			result.Headers.Del(from)
+			for _, v := range values {
+				result.Headers.Add(to, v)
+			}
+		}
+	}
+	for name, tmpl := range t.headers {
+		value, err := execute(tmpl)
+		if err != nil {
+			return nil, err
+		}
+		result.Headers.Set(name, value)
+	}
+
+	if request.BodyBlob != "" && (t.bodyTemplate != nil || len(t.BodyMapping) > 0) {
+		return nil, fmt.Errorf("transform of the body is not possible, the body is spooled")
+	}
+	switch {
+	case t.bodyTemplate != nil:
+		body, err := execute(t.bodyTemplate)
+		if err != nil {
+			return nil, err
+		}
+		result.Body = []byte(body)
+		result.Headers.Del("Content-Encoding")
+	case len(t.BodyMapping) > 0:
+		body, err := mapBody(request.content(), t.BodyMapping)
+		if err != nil {
+			return nil, err
+		}
+		result.Body = body
+		result.Headers.Del("Content-Encoding")
+	}
+	return result, nil
+}
+
+// mapBody builds a new JSON object out of the values of the JSON body, the missing ones are null
+func mapBody(body []byte, mapping map[string]string) ([]byte, error) {
+	out := make(map[string]interface{})
+	for to, from := range mapping {
+		keys := strings.Split(to, ".")
+		parent := out
+		for _, key := range keys[:len(keys)-1] {
+			child, ok := parent[key].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				parent[key] = child
+			}
+			parent = child
+		}
+		parent[keys[len(keys)-1]] = gjson.GetBytes(body, from).Value()
+	}
+	return json.Marshal(out)
+}
@@ -0,0 +1,62 @@
+package core
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestTransformApply(t *testing.T) {
+	transform := &Transform{
+		Url:           "http://localhost/{{ segment 1 }}",
+		RemoveHeaders: []string{"X-Secret"},
+		SetHeaders:    map[string]string{"X-Event": `{{ body "type" }}`},
+		BodyMapping:   map[string]string{"event.id": "id"},
+	}
+	request := &Request{
+		Method:  "POST",
+		Path:    "/hooks/orders",
+		Headers: map[string][]string{"X-Secret": {"s3cr3t"}},
+		Body:    []byte(`{"id":"evt_1","type":"order.created"}`),
+	}
+
+	check := func(transformed *TransformedRequest, err error) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if transformed.Url != "http://localhost/orders" {
+			t.Errorf("Url = %s", transformed.Url)
+		}
+		if transformed.Headers.Get("X-Event") != "order.created" || transformed.Headers.Get("X-Secret") != "" {
+			t.Errorf("Headers = %v", transformed.Headers)
+		}
+		if string(transformed.Body) != `{"event":{"id":"evt_1"}}` {
+			t.Errorf("Body = %s", transformed.Body)
+		}
+	}
+
+	// Not verified, as when it comes from a stored Request, then verified on a copy, as by the preview: the shared
+	// Transform is never changed, which -race would tell
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			check(transform.Apply(request, "http://localhost"))
+		}()
+		go func() {
+			defer wg.Done()
+			clone := *transform
+			if err := clone.Verify(); err != nil {
+				t.Error(err)
+				return
+			}
+			check(clone.Apply(request, "http://localhost"))
+		}()
+	}
+	wg.Wait()
+
+	if transform.headers != nil {
+		t.Error("the shared Transform has been compiled")
+	}
+}
@@ -0,0 +1,223 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SignatureProviderGitHub  = "github"
+	SignatureProviderStripe  = "stripe"
+	SignatureProviderSlack   = "slack"
+	SignatureProviderShopify = "shopify"
+	SignatureProviderGeneric = "generic"
+
+	defaultSignatureTolerance = 5 * time.Minute
+)
+
+var (
+	ErrSignatureMissing  = errors.New("signature is missing")
+	ErrSignatureMismatch = errors.New("signature does not match")
+	ErrSignatureExpired  = errors.New("signature timestamp is outside of the tolerance")
+)
+
+// SignatureVerification checks the signature that the provider has computed over the body of the incoming request,
+// before anything is forwarded or stored. It is not stored directly in the database but as a child/nested object of
+// the Webhook.
+type SignatureVerification struct {
+	Provider string `bson:"provider"  json:"provider"`
+	Secret   string `bson:"secret"    json:"secret"`
+	// Tolerance is the maximum age of the signed timestamp (Stripe & Slack), defaults to 5 minutes
+	Tolerance Duration `bson:"tolerance"  json:"tolerance"`
+
+	// Generic provider only: the Header holding the signature, the Algorithm (sha1, sha256 or sha512), the Encoding
+	// (hex or base64) and an optional Prefix such as "sha256="
+	Header    string `bson:"header"     json:"header"`
+	Algorithm string `bson:"algorithm"  json:"algorithm"`
+	Encoding  string `bson:"encoding"   json:"encoding"`
+	Prefix    string `bson:"prefix"     json:"prefix"`
+
+	// StoreRejected keeps the rejected requests for auditing
+	StoreRejected int `bson:"storeRejected"  json:"storeRejected"`
+}
+
+func (v *SignatureVerification) Verify() error {
+	if v.Secret == "" {
+		return fmt.Errorf("signature verification requires a secret")
+	}
+	switch v.Provider {
+	case SignatureProviderGitHub, SignatureProviderStripe, SignatureProviderSlack, SignatureProviderShopify:
+		return nil
+	case SignatureProviderGeneric:
+		if v.Header == "" {
+			return fmt.Errorf("generic signature verification requires a header")
+		}
+		if hashFunc(v.Algorithm) == nil {
+			return fmt.Errorf("unsupported signature algorithm: %s", v.Algorithm)
+		}
+		if v.Encoding != "hex" && v.Encoding != "base64" {
+			return fmt.Errorf("unsupported signature encoding: %s", v.Encoding)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported signature provider: %s", v.Provider)
+}
+
+// Check verifies the signature of an incoming request, `now` is used for the providers that sign a timestamp. The body
+// is read through, it is never fully buffered.
+func (v *SignatureVerification) Check(header http.Header, body io.Reader, now time.Time) error {
+	switch v.Provider {
+	case SignatureProviderGitHub:
+		signature := strings.TrimPrefix(header.Get("X-Hub-Signature-256"), "sha256=")
+		mac, err := bodyHMAC(sha256.New, v.Secret, "", body)
+		if err != nil {
+			return err
+		}
+		return compareSignature(signature, hex.EncodeToString(mac))
+
+	case SignatureProviderStripe:
+		timestamp, signatures := parseStripeSignature(header.Get("Stripe-Signature"))
+		if err := v.checkTimestamp(timestamp, now); err != nil {
+			return err
+		}
+		mac, err := bodyHMAC(sha256.New, v.Secret, timestamp+".", body)
+		if err != nil {
+			return err
+		}
+		expected := hex.EncodeToString(mac)
+		for _, signature := range signatures {
+			if compareSignature(signature, expected) == nil {
+				return nil
+			}
+		}
+		if len(signatures) == 0 {
+			return ErrSignatureMissing
+		}
+		return ErrSignatureMismatch
+
+	case SignatureProviderSlack:
+		timestamp := header.Get("X-Slack-Request-Timestamp")
+		if err := v.checkTimestamp(timestamp, now); err != nil {
+			return err
+		}
+		signature := strings.TrimPrefix(header.Get("X-Slack-Signature"), "v0=")
+		mac, err := bodyHMAC(sha256.New, v.Secret, "v0:"+timestamp+":", body)
+		if err != nil {
+			return err
+		}
+		return compareSignature(signature, hex.EncodeToString(mac))
+
+	case SignatureProviderShopify:
+		mac, err := bodyHMAC(sha256.New, v.Secret, "", body)
+		if err != nil {
+			return err
+		}
+		return compareSignature(header.Get("X-Shopify-Hmac-Sha256"), base64.StdEncoding.EncodeToString(mac))
+
+	case SignatureProviderGeneric:
+		signature := header.Get(v.Header)
+		if v.Prefix != "" {
+			if !strings.HasPrefix(signature, v.Prefix) {
+				return ErrSignatureMismatch
+			}
+			signature = strings.TrimPrefix(signature, v.Prefix)
+		}
+		mac, err := bodyHMAC(hashFunc(v.Algorithm), v.Secret, "", body)
+		if err != nil {
+			return err
+		}
+		if v.Encoding == "base64" {
+			return compareSignature(signature, base64.StdEncoding.EncodeToString(mac))
+		}
+		// Hex signatures are case-insensitive
+		return compareSignature(strings.ToLower(signature), hex.EncodeToString(mac))
+	}
+	return fmt.Errorf("unsupported signature provider: %s", v.Provider)
+}
+
+func (v *SignatureVerification) checkTimestamp(timestamp string, now time.Time) error {
+	if timestamp == "" {
+		return ErrSignatureMissing
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid signature timestamp: %s", timestamp)
+	}
+	tolerance := time.Duration(v.Tolerance)
+	if tolerance <= 0 {
+		tolerance = defaultSignatureTolerance
+	}
+	age := now.Sub(time.Unix(seconds, 0))
+	if age > tolerance || age < -tolerance {
+		return ErrSignatureExpired
+	}
+	return nil
+}
+
+// parseStripeSignature parses a `t=...,v1=...,v1=...` header, there can be multiple v1 signatures while the secret is
+// being rolled.
+func parseStripeSignature(value string) (timestamp string, signatures []string) {
+	for _, part := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+	return timestamp, signatures
+}
+
+func hashFunc(algorithm string) func() hash.Hash {
+	switch algorithm {
+	case "sha1":
+		return sha1.New
+	case "sha256":
+		return sha256.New
+	case "sha512":
+		return sha512.New
+	}
+	return nil
+}
+
+func hexHMAC(h func() hash.Hash, secret string, data []byte) string {
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// bodyHMAC computes the HMAC of the prefix followed by the body, as it is read
+func bodyHMAC(h func() hash.Hash, secret, prefix string, body io.Reader) ([]byte, error) {
+	mac := hmac.New(h, []byte(secret))
+	mac.Write([]byte(prefix))
+	if _, err := io.Copy(mac, body); err != nil {
+		return nil, err
+	}
+	return mac.Sum(nil), nil
+}
+
+func compareSignature(signature, expected string) error {
+	if signature == "" {
+		return ErrSignatureMissing
+	}
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return ErrSignatureMismatch
+	}
+	return nil
+}
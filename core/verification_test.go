@@ -0,0 +1,78 @@
+package core
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignatureVerificationCheck(t *testing.T) {
+	// From GitHub's documentation on validating webhook deliveries
+	githubBody := "Hello, World!"
+	github := &SignatureVerification{Provider: SignatureProviderGitHub, Secret: "It's a Secret to Everybody"}
+	githubSignature := "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17"
+
+	// The test event of Stripe's libraries, signed as their generateTestHeaderString does
+	stripeBody := "{\n  \"id\": \"evt_test_webhook\",\n  \"object\": \"event\"\n}"
+	stripe := &SignatureVerification{Provider: SignatureProviderStripe, Secret: "whsec_test_secret"}
+	stripeSignature := "c2f890decbc5ede7c5060bb9a6d31e0626a4342bacb9aeae2adb1bcea72f9812"
+	stripeTime := time.Unix(1492774577, 0)
+
+	// From Slack's documentation on verifying requests
+	slackBody := "token=xyzz0WbapA4vBCDEFasx0q6G&team_id=T1DC2JH3J&team_domain=testteamnow&channel_id=G8PSS9T3V" +
+		"&channel_name=foobar&user_id=U2CERLKJA&user_name=roadrunner&command=%2Fwebhook-collect&text=" +
+		"&response_url=https%3A%2F%2Fhooks.slack.com%2Fcommands%2FT1DC2JH3J%2F397700885554%2F96rGlfmibIGlgcZRskXaIFfN" +
+		"&trigger_id=398738663015.47445629121.803a0bc887a14d10d2c447fce8b6703c"
+	slack := &SignatureVerification{Provider: SignatureProviderSlack, Secret: "8f742231b10e8888abcd99yyyzzz85a5"}
+	slackSignature := "v0=a2114d57b48eac39b9ad189dd8316235a7b4a8d21a10bd27519666489c69b503"
+	slackTime := time.Unix(1531420618, 0)
+
+	// Shopify doesn't publish one, this is the base64 HMAC-SHA256 of the body as computed by openssl
+	shopifyBody := `{"id":820982911946154508,"email":"jon@doe.ca"}`
+	shopify := &SignatureVerification{Provider: SignatureProviderShopify, Secret: "hush"}
+	shopifySignature := "fp5HwmAHEVGQQwJU1KRpk57Ts2YHF6/TLOCczCtB5bs="
+
+	tests := []struct {
+		name         string
+		verification *SignatureVerification
+		header       map[string]string
+		body         string
+		now          time.Time
+		want         error
+	}{
+		{"github", github, map[string]string{"X-Hub-Signature-256": githubSignature}, githubBody, time.Now(), nil},
+		{"github tampered", github, map[string]string{"X-Hub-Signature-256": githubSignature}, githubBody + " ", time.Now(), ErrSignatureMismatch},
+		{"github missing", github, map[string]string{}, githubBody, time.Now(), ErrSignatureMissing},
+
+		{"stripe", stripe, map[string]string{"Stripe-Signature": "t=1492774577,v1=" + stripeSignature}, stripeBody, stripeTime, nil},
+		{"stripe rolled secret", stripe, map[string]string{"Stripe-Signature": "t=1492774577,v1=0000,v1=" + stripeSignature + ",v0=1111"}, stripeBody, stripeTime, nil},
+		{"stripe tampered", stripe, map[string]string{"Stripe-Signature": "t=1492774578,v1=" + stripeSignature}, stripeBody, stripeTime, ErrSignatureMismatch},
+		{"stripe expired", stripe, map[string]string{"Stripe-Signature": "t=1492774577,v1=" + stripeSignature}, stripeBody, stripeTime.Add(6 * time.Minute), ErrSignatureExpired},
+		{"stripe in the future", stripe, map[string]string{"Stripe-Signature": "t=1492774577,v1=" + stripeSignature}, stripeBody, stripeTime.Add(-6 * time.Minute), ErrSignatureExpired},
+		{"stripe missing", stripe, map[string]string{}, stripeBody, stripeTime, ErrSignatureMissing},
+		{"stripe missing signature", stripe, map[string]string{"Stripe-Signature": "t=1492774577"}, stripeBody, stripeTime, ErrSignatureMissing},
+
+		{"slack", slack, map[string]string{"X-Slack-Request-Timestamp": "1531420618", "X-Slack-Signature": slackSignature}, slackBody, slackTime.Add(time.Minute), nil},
+		{"slack tampered", slack, map[string]string{"X-Slack-Request-Timestamp": "1531420619", "X-Slack-Signature": slackSignature}, slackBody, slackTime, ErrSignatureMismatch},
+		{"slack expired", slack, map[string]string{"X-Slack-Request-Timestamp": "1531420618", "X-Slack-Signature": slackSignature}, slackBody, slackTime.Add(6 * time.Minute), ErrSignatureExpired},
+		{"slack missing timestamp", slack, map[string]string{"X-Slack-Signature": slackSignature}, slackBody, slackTime, ErrSignatureMissing},
+		{"slack missing signature", slack, map[string]string{"X-Slack-Request-Timestamp": "1531420618"}, slackBody, slackTime, ErrSignatureMissing},
+
+		{"shopify", shopify, map[string]string{"X-Shopify-Hmac-Sha256": shopifySignature}, shopifyBody, time.Now(), nil},
+		{"shopify tampered", shopify, map[string]string{"X-Shopify-Hmac-Sha256": shopifySignature}, shopifyBody + " ", time.Now(), ErrSignatureMismatch},
+		{"shopify missing", shopify, map[string]string{}, shopifyBody, time.Now(), ErrSignatureMissing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for name, value := range tt.header {
+				header.Set(name, value)
+			}
+			if err := tt.verification.Check(header, strings.NewReader(tt.body), tt.now); !errors.Is(err, tt.want) {
+				t.Errorf("Check() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -1,18 +1,21 @@
 package core
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"io"
+	"net"
 	"net/http"
 	"sync"
 	"time"
 
 	"github.com/eliezedeck/gobase/logging"
-	"github.com/eliezedeck/gobase/random"
 	"github.com/eliezedeck/gobase/web"
 	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -24,200 +27,450 @@ type Webhook struct {
 	Path        string        `bson:"path"         json:"path"         validate:"required"`
 	ForwardUrls []*ForwardUrl `bson:"forwardUrls"  json:"forwardUrls"  validate:"required"`
 
+	// Verification of the provider's signature, optional
+	Verification *SignatureVerification `bson:"verification" json:"verification"`
+	// Retention of the stored Requests, the DefaultRetention applies if not set
+	Retention *RetentionPolicy `bson:"retention" json:"retention"`
+	// Acknowledge, when set, responds right after the Requests are stored instead of waiting on a Forward URL
+	Acknowledge *Acknowledgement `bson:"acknowledge" json:"acknowledge"`
+	// Handshakes answer the verification challenges of the providers, optional
+	Handshakes []*Handshake `bson:"handshakes" json:"handshakes"`
+	// Deduplication of the calls that the providers retry, optional
+	Deduplication *Deduplication `bson:"deduplication" json:"deduplication"`
+	// Access restricts who can call the Webhook, optional
+	Access *AccessPolicy `bson:"access" json:"access"`
+	// MaxBodySize of the calls in bytes, they get a 413 beyond it; 0 uses the global MaxBodySize
+	MaxBodySize int64 `bson:"maxBodySize" json:"maxBodySize"`
+	// DecompressBodies stores the gzip and deflate bodies decompressed, so that they can be read and searched; they are
+	// forwarded decompressed as well. The spooled bodies are always stored as they were sent.
+	DecompressBodies int `bson:"decompressBodies" json:"decompressBodies"`
+
+	// Source is WebhookSourceConfig for the Webhooks declared in the config file, they are overwritten or removed
+	// whenever the file changes. Empty for the ones created through the administration.
+	Source string `bson:"source,omitempty" json:"source,omitempty"`
+
 	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
 }
 
 func (w *Webhook) Verify() error {
-	// There must be exactly one forward url with the returnAsResponse flag set to true
-	returnAsResponseCount := 0
-	for _, furl := range w.ForwardUrls {
-		if furl.ReturnAsResponse >= 1 {
-			returnAsResponseCount++
-			if returnAsResponseCount > 1 {
-				return fmt.Errorf("webhook has more than one forward url with returnAsResponse set to true")
+	if w.Acknowledge != nil {
+		// Nothing is waited on, the forwards all happen in the background
+		if err := w.Acknowledge.Verify(); err != nil {
+			return err
+		}
+		for _, furl := range w.ForwardUrls {
+			if furl.ReturnAsResponse >= 1 || furl.WaitTillCompletion >= 1 {
+				return fmt.Errorf("webhook that acknowledges must not have a forward url with returnAsResponse or waitForCompletion set to true")
+			}
+		}
+	} else {
+		// There must be exactly one forward url with the returnAsResponse flag set to true
+		returnAsResponseCount := 0
+		for _, furl := range w.ForwardUrls {
+			if furl.ReturnAsResponse >= 1 {
+				returnAsResponseCount++
+				if returnAsResponseCount > 1 {
+					return fmt.Errorf("webhook has more than one forward url with returnAsResponse set to true")
+				}
 			}
 		}
+		if returnAsResponseCount == 0 {
+			return fmt.Errorf("webhook has no forward url with returnAsResponse set to true")
+		}
+	}
+
+	if w.Verification != nil {
+		if err := w.Verification.Verify(); err != nil {
+			return err
+		}
+	}
+	if w.Retention != nil {
+		if err := w.Retention.Verify(); err != nil {
+			return err
+		}
 	}
-	if returnAsResponseCount == 0 {
-		return fmt.Errorf("webhook has no forward url with returnAsResponse set to true")
+	if w.Deduplication != nil {
+		if err := w.Deduplication.Verify(); err != nil {
+			return err
+		}
+	}
+	if w.Access != nil {
+		if err := w.Access.Verify(); err != nil {
+			return err
+		}
+	}
+	if w.MaxBodySize < 0 {
+		return fmt.Errorf("max body size must not be negative")
+	}
+	for i, h := range w.Handshakes {
+		if h == nil {
+			return fmt.Errorf("handshake must not be empty")
+		}
+		if err := h.Verify(); err != nil {
+			return err
+		}
+		for _, other := range w.Handshakes[:i] {
+			if other.Provider == h.Provider {
+				return fmt.Errorf("webhook has more than one %s handshake", h.Provider)
+			}
+		}
+	}
+	for _, furl := range w.ForwardUrls {
+		if furl.Retry != nil {
+			if err := furl.Retry.Verify(); err != nil {
+				return err
+			}
+		}
+		if furl.Signing != nil {
+			if err := furl.Signing.Verify(); err != nil {
+				return err
+			}
+		}
+		if err := furl.Match.Verify(); err != nil {
+			return err
+		}
+		if furl.Transform != nil {
+			if err := furl.Transform.Verify(); err != nil {
+				return err
+			}
+		}
+		if furl.CircuitBreaker != nil {
+			if err := furl.CircuitBreaker.Verify(); err != nil {
+				return err
+			}
+		}
+		if furl.RateLimit != nil {
+			if err := furl.RateLimit.Verify(); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
 
-var (
-	webhooksCache   = make(map[string]*Webhook)
-	webhooksCacheMu = &sync.Mutex{}
-)
+// serve handles a call to the Webhook, it is dispatched by the webhooks router
+func (w *Webhook) serve(c echo.Context, storage RequestsStorage) error {
+	reqId := fmt.Sprintf("r-%s", RandomString(16))
 
-func (w *Webhook) RegisterWithEcho(e *echo.Echo, storage RequestsStorage) error {
-	if err := w.Verify(); err != nil {
-		return err
+	// The span continues the trace of the caller, if any. The forwards may outlive the call, so they only keep the
+	// span but not the context of the call.
+	_, span := tracer.Start(propagator.Extract(c.Request().Context(), propagation.HeaderCarrier(c.Request().Header)),
+		fmt.Sprintf("webhook %s", w.ID), trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("webhook.id", w.ID),
+			attribute.String("request.id", reqId),
+			semconv.HTTPMethodKey.String(c.Request().Method),
+			semconv.HTTPTargetKey.String(c.Request().URL.RequestURI())))
+	defer func() {
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(c.Response().Status))
+		span.End()
+	}()
+	traceCtx := trace.ContextWithSpan(context.Background(), span)
+
+	L := logging.L.Named(fmt.Sprintf("Webhook[%s:%s]", w.ID, w.Path)).With(
+		zap.String("requestId", reqId),
+		zap.Time("time", time.Now()),
+		zap.Any("headers", c.Request().Header))
+
+	//
+	// Webhook has been called
+	//
+
+	// Refuse the unwanted callers before anything else, they don't even get to send their body
+	if w.Access != nil {
+		ip := c.RealIP()
+		if reason := w.Access.refusal(net.ParseIP(ip)); reason != "" {
+			L.Warn("Caller is not allowed", zap.String("ip", ip), zap.String("reason", reason))
+			metricRequestsRejected.WithLabelValues(w.ID, reason).Inc()
+			return c.String(http.StatusForbidden, "403 Forbidden")
+		}
+		if limiter := inboundLimiterFor(w); limiter != nil && !limiter.allow(ip, time.Now()) {
+			L.Warn("Caller is over the rate limit", zap.String("ip", ip))
+			metricRequestsRejected.WithLabelValues(w.ID, "rate_limited").Inc()
+			return c.String(http.StatusTooManyRequests, "429 Too Many Requests")
+		}
 	}
 
-	// Cache this Webhook
-	// - Upon Webhook update, this makes sure that handler will use the updated version, not the initial one
-	// - This is used to ensure that the same Webhook is not registered twice
-	key := fmt.Sprintf("%s %s", w.Method, w.Path)
-	webhooksCacheMu.Lock()
-	_, found := webhooksCache[key]
-	webhooksCache[key] = w
-	webhooksCacheMu.Unlock()
-	if found {
-		logging.L.Info("Webhook already registered, only Cache entry is updated: {key}", zap.String("id", w.ID), zap.String("key", key))
-		return nil
+	// Get the full body of the request, the large ones are spooled as they are read. The spooled body is kept by the
+	// Request of the call, if it is stored; the Requests of the forwards get their own copy.
+	maxBodySize := w.maxBodySize()
+	if maxBodySize > 0 && c.Request().ContentLength > maxBodySize {
+		metricRequestsRejected.WithLabelValues(w.ID, "too_large").Inc()
+		return c.String(http.StatusRequestEntityTooLarge, "413 Request Entity Too Large")
+	}
+	body, err := readPayload(c.Request().Body, reqId, maxBodySize)
+	if err != nil {
+		if errors.Is(err, ErrBodyTooLarge) {
+			L.Warn("Request body is too large", zap.Int64("maxBodySize", maxBodySize))
+			metricRequestsRejected.WithLabelValues(w.ID, "too_large").Inc()
+			return c.String(http.StatusRequestEntityTooLarge, "413 Request Entity Too Large")
+		}
+		L.Error("Could not read the body of the request", zap.Error(err))
+		return c.String(http.StatusInternalServerError, "500 Internal Server Error")
 	}
+	bodyKept := false
+	defer func() {
+		if !bodyKept {
+			body.discard()
+		}
+	}()
+	coding := contentCoding(c.Request().Header)
+	decompressed, err := body.decompress(coding, maxBodySize)
+	switch {
+	case errors.Is(err, ErrBodyTooLarge):
+		L.Warn("Request body is too large once decompressed", zap.Int64("maxBodySize", maxBodySize))
+		metricRequestsRejected.WithLabelValues(w.ID, "too_large").Inc()
+		return c.String(http.StatusRequestEntityTooLarge, "413 Request Entity Too Large")
+	case err != nil:
+		// Looked into as it is
+		L.Warn("Could not decompress the body of the request", zap.Error(err), zap.String("encoding", coding))
+	}
+	if body.blob != "" {
+		L.Info("Request body has been spooled", zap.Int64("size", body.size))
+	} else {
+		L.Info("Request body", bodyField(body.content))
+	}
+
+	// The challenges of the providers are answered before the signature verification, most of them aren't signed
+	for _, h := range w.Handshakes {
+		if answered, err := h.answer(c, body.content); answered {
+			L.Info("Handshake has been answered", zap.String("provider", h.Provider))
+			return err
+		}
+	}
+	if !w.receives(c.Request().Method) {
+		// Only routed for the handshakes
+		return c.String(http.StatusMethodNotAllowed, "405 Method Not Allowed")
+	}
+	metricRequestsReceived.WithLabelValues(w.ID).Inc()
+	metricBytesReceived.WithLabelValues(w.ID).Add(float64(body.size))
+
+	//
+	// Webhook body is now available
+	//
 
-	// Support a special method called ANY, which will match any method
-	handler := func(c echo.Context) error {
-		reqId := fmt.Sprintf("r-%s", random.String(16))
+	newRequest := func(furl *ForwardUrl) *Request {
+		// Each forward gets its own Request, so that they can be retried and replayed independently
+		id := reqId
+		forwardUrlId := ""
+		status := ""
+		lockedUntil := time.Time{}
+		bodyBlob := ""
+		if furl != nil {
+			id = fmt.Sprintf("%s-%s", reqId, furl.ID)
+			forwardUrlId = furl.ID
+			status = RequestStatusPending
 
-		// Always get the freshest version of the webhook from the Cache
-		webhooksCacheMu.Lock()
-		currentWebhook := webhooksCache[key]
-		webhooksCacheMu.Unlock()
+			// The first attempt is made right here, keep the delivery workers away from it in the meantime
+			lockedUntil = time.Now().Add(time.Duration(furl.Timeout) + deliveryLease)
+		}
+		if body.blob != "" {
+			bodyBlob = id
+		}
+		request := &Request{
+			ID:       id,
+			Method:   c.Request().Method,
+			Path:     c.Request().URL.Path,
+			Query:    c.Request().URL.RawQuery,
+			Headers:  c.Request().Header,
+			Body:     body.inline,
+			BodyBlob: bodyBlob,
+			BodySize: body.size,
 
-		L := logging.L.Named(fmt.Sprintf("Webhook[%s:%s]", currentWebhook.ID, currentWebhook.Path)).With(
-			zap.String("requestId", reqId),
-			zap.Time("time", time.Now()),
-			zap.Any("headers", c.Request().Header))
+			ContentEncoding: coding,
+			FromWebhookId:   w.ID,
+			CreatedAt:       time.Now(),
 
-		//
-		// Webhook has been called
-		//
+			Status:        status,
+			NextAttemptAt: time.Now(),
+			LockedUntil:   lockedUntil,
 
-		// Get the full body of the request
-		body, err := io.ReadAll(c.Request().Body)
-		if err != nil {
-			L.Error("Could not read the body of the request", zap.Error(err))
-			return c.String(http.StatusInternalServerError, "500 Internal Server Error")
+			ReplayPayload: &Replay{
+				RequestId:       id,
+				WebhookId:       w.ID,
+				ForwardUrlId:    forwardUrlId,
+				DeleteOnSuccess: 0,
+			},
 		}
-		L.Info("Request body", zap.ByteString("body", body))
-
-		//
-		// Webhook body is now available
-		//
-
-		saveRequest := func(furl *ForwardUrl) {
-			// Save the request
-			forwardUrlId := ""
-			if furl != nil {
-				forwardUrlId = furl.ID
-			}
-			request := &Request{
-				ID:            reqId,
-				Method:        c.Request().Method,
-				Path:          c.Request().URL.Path,
-				Headers:       c.Request().Header,
-				Body:          string(body),
-				ForwardUrl:    furl,
-				FromWebhookId: currentWebhook.ID,
-				CreatedAt:     time.Now(),
-
-				ReplayPayload: &Replay{
-					RequestId:       reqId,
-					WebhookId:       currentWebhook.ID,
-					ForwardUrlId:    forwardUrlId,
-					DeleteOnSuccess: 0,
-				},
-			}
-			if err := storage.StoreRequest(request); err != nil {
-				L.Error("Error saving request", zap.Error(err), zap.String("webhookId", currentWebhook.ID))
-			} else {
-				L.Info("Request has been saved", zap.String("id", request.ID))
-			}
-		}
-
-		responseErr := make(chan error, 1)
-		if currentWebhook.Enabled >= 1 && len(currentWebhook.ForwardUrls) > 0 {
-			wg := &sync.WaitGroup{}
-			for _, furl := range currentWebhook.ForwardUrls {
-				if furl.WaitTillCompletion >= 1 {
-					wg.Add(1)
+		if furl != nil {
+			request.setForwardUrl(furl)
+		}
+		return request
+	}
+
+	saveRequest := func(request *Request) error {
+		request.ExpiresAt = retentionFor(w.ID).expiresAt(request.Status, time.Now())
+		err := traceStorage(traceCtx, "StoreRequest", request.ID, func() error {
+			if request.BodyBlob != "" && request.BodyBlob != body.blob {
+				if err := copyBlob(body.blob, request.BodyBlob); err != nil {
+					return err
 				}
+			}
+			return storage.StoreRequest(request)
+		})
+		if err != nil {
+			L.Error("Error saving request", zap.Error(err), zap.String("webhookId", w.ID))
+		} else {
+			L.Info("Request has been saved", zap.String("id", request.ID))
+			if request.BodyBlob == body.blob {
+				bodyKept = true
+			}
+		}
+		return err
+	}
 
-				go func(furl *ForwardUrl) {
-					ctx, cancel := context.WithTimeout(context.Background(), furl.Timeout)
-					defer func() {
-						cancel()
-						if furl.WaitTillCompletion >= 1 {
-							wg.Done()
-						}
-					}()
-
-					// Prepare a new request, transfer the headers
-					request, _ := http.NewRequestWithContext(ctx, c.Request().Method, furl.Url, bytes.NewReader(body))
-					TransferHeaders(request.Header, c.Request().Header)
-
-					// Execute the request
-					response, err := ForwardHttpClient.Do(request)
-					if err != nil {
-						// Error executing: Rebuilt request -> Forwarded host
-						saveRequest(furl)
-						if furl.ReturnAsResponse >= 1 {
-							responseErr <- err
-						}
-						return
-					}
-					defer func() {
-						_ = response.Body.Close()
-					}()
-
-					// Always fully read the body
-					fbody, err := io.ReadAll(response.Body)
-					if err != nil {
-						// Error reading: Body <- Forwarded host
-						saveRequest(furl)
-						if furl.ReturnAsResponse >= 1 {
-							responseErr <- err
-						}
-						return
-					}
+	// Reject the requests that don't carry a valid signature from the provider
+	if w.Verification != nil {
+		content, err := body.open()
+		if err == nil {
+			err = w.Verification.Check(c.Request().Header, content, time.Now())
+			_ = content.Close()
+		}
+		if err != nil {
+			L.Warn("Request signature verification has failed", zap.Error(err))
+			metricRequestsRejected.WithLabelValues(w.ID, "signature").Inc()
+			if w.Verification.StoreRejected >= 1 {
+				request := newRequest(nil)
+				request.Status = RequestStatusRejected
+				request.Rejection = err.Error()
+				_ = saveRequest(request)
+			}
+			return c.String(http.StatusUnauthorized, "401 Unauthorized")
+		}
+	}
 
-					if furl.ReturnAsResponse >= 1 {
-						// Body from Forwarded host -> Webhook caller
-						TransferHeaders(c.Response().Header(), response.Header)
-						c.Response().WriteHeader(response.StatusCode)
-						_, err = c.Response().Write(fbody)
-						if err != nil {
-							saveRequest(furl)
-							responseErr <- err
-							return
-						} else {
-							// Success
-							responseErr <- nil
-						}
-					}
+	// The compressed bodies are stored decompressed if asked to, only once their signature has been checked
+	if decompressed && w.DecompressBodies >= 1 {
+		body.keepDecompressed()
+		coding = ""
+		c.Request().Header.Del("Content-Encoding")
+		c.Request().Header.Del("Content-Length")
+	}
 
-					if furl.KeepSuccessfulRequests >= 1 {
-						// Save the request
-						saveRequest(furl)
+	// The duplicates get the response of the original call, they are neither stored nor forwarded
+	if w.Deduplication != nil {
+		if key := w.Deduplication.keyOf(c.Request().Header, body); key != "" {
+			record := newIdempotencyRecord(w.ID, key, reqId, w.Deduplication.window(), w.idempotencyLease(), time.Now())
+			original, err := storage.ClaimIdempotencyKey(record, time.Now())
+			switch {
+			case err != nil:
+				// Better forward it twice than not at all
+				L.Error("Error claiming the idempotency key", zap.Error(err))
+			case original != nil:
+				L.Info("Duplicate call is suppressed", zap.String("originalRequestId", original.RequestId))
+				metricRequestsRejected.WithLabelValues(w.ID, "duplicate").Inc()
+				return original.replay(c)
+			default:
+				recorder := &recordingWriter{ResponseWriter: c.Response().Writer}
+				c.Response().Writer = recorder
+				defer func() {
+					if err := settleIdempotencyKey(storage, record, c.Response(), recorder); err != nil {
+						L.Error("Error saving the idempotency key", zap.Error(err))
 					}
-				}(furl)
+				}()
 			}
+		}
+	}
 
-			wg.Wait()
-		} else {
-			saveRequest(nil)
-			responseErr <- web.OK(c)
+	responseErr := make(chan error, 1)
+	if len(w.ForwardUrls) > 0 {
+		// Write all the requests first, they are only delivered after that. The ones that don't match the rules of
+		// their Forward URL are kept as skipped, along with the reason.
+		requests := make([]*Request, len(w.ForwardUrls))
+		var saveErr error
+		for i, furl := range w.ForwardUrls {
+			requests[i] = newRequest(furl)
+			if reason := furl.Match.SkipReason(c.Request(), body.content); reason != "" {
+				requests[i].Status = RequestStatusSkipped
+				requests[i].LockedUntil = time.Time{}
+				requests[i].Rejection = reason
+				L.Info("Forward is skipped", zap.String("forwardUrlId", furl.ID), zap.String("reason", reason))
+			}
+			if err := saveRequest(requests[i]); err != nil {
+				saveErr = err
+			}
 		}
 
-		err = <-responseErr
-		if err != nil {
-			L.Error("Unsuccessful Webhook handling: {error}", zap.Error(err))
+		if w.Acknowledge != nil {
+			// The caller only gets the acknowledgement once all the Requests are durably stored, so that it can retry
+			// otherwise. The ones that were stored are delivered by the workers, once their lock expires.
+			if saveErr != nil {
+				return c.String(http.StatusInternalServerError, "500 Internal Server Error")
+			}
+			responseErr <- w.Acknowledge.respond(c)
 		}
-		return err
-	}
-	if w.Method == "ANY" {
-		e.Any(w.Path, handler)
-		logging.L.Info("Special ANY catch-all method for {path}", zap.String("path", w.Path))
+
+		wg := &sync.WaitGroup{}
+		for _, request := range requests {
+			furl := request.forwardUrl()
+			if request.Status == RequestStatusSkipped {
+				if furl.ReturnAsResponse >= 1 {
+					responseErr <- web.OK(c)
+				}
+				continue
+			}
+			if furl.WaitTillCompletion >= 1 {
+				wg.Add(1)
+			}
+
+			go func(request *Request, furl *ForwardUrl) {
+				ctx, cancel := context.WithTimeout(traceCtx, time.Duration(furl.Timeout))
+				defer func() {
+					cancel()
+					if furl.WaitTillCompletion >= 1 {
+						wg.Done()
+					}
+				}()
+
+				// Execute the request, once the rate limit of the Forward URL allows it. Only the callers that wait
+				// on it wait for their turn, the other Requests are queued.
+				var (
+					response *http.Response
+					fbody    []byte
+				)
+				release, err := throttleForward(ctx, request, furl.ReturnAsResponse >= 1 || furl.WaitTillCompletion >= 1)
+				if err == nil {
+					response, fbody, err = forwardRequest(ctx, storage, request)
+					release()
+				}
+				var writeErr error
+				if err != nil {
+					if furl.ReturnAsResponse >= 1 {
+						responseErr <- err
+					}
+				} else if furl.ReturnAsResponse >= 1 {
+					// Body from Forwarded host -> Webhook caller
+					TransferHeaders(c.Response().Header(), response.Header)
+					c.Response().WriteHeader(response.StatusCode)
+					_, writeErr = c.Response().Write(fbody)
+					responseErr <- writeErr
+				}
+
+				// A request that could not be returned to the Webhook caller is always kept
+				if err := settleRequest(traceCtx, storage, request, response, err, writeErr != nil); err != nil {
+					L.Error("Error updating request after forward", zap.Error(err), zap.String("id", request.ID))
+				} else if request.Status != RequestStatusDelivered {
+					L.Info("Forward has failed, request has been saved", zap.String("id", request.ID), zap.String("status", request.Status))
+				}
+			}(request, furl)
+		}
+
+		wg.Wait()
 	} else {
-		e.Add(w.Method, w.Path, handler)
+		err := saveRequest(newRequest(nil))
+		switch {
+		case w.Acknowledge == nil:
+			responseErr <- web.OK(c)
+		case err != nil:
+			return c.String(http.StatusInternalServerError, "500 Internal Server Error")
+		default:
+			responseErr <- w.Acknowledge.respond(c)
+		}
 	}
 
-	logging.L.Info("Webhook has been registered: {method} {path} — {name}",
-		zap.String("id", w.ID),
-		zap.String("method", w.Method),
-		zap.String("path", w.Path),
-		zap.String("name", w.Name))
-	return nil
+	err = <-responseErr
+	if err != nil {
+		L.Error("Unsuccessful Webhook handling: {error}", zap.Error(err))
+	}
+	return err
 }
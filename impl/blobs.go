@@ -0,0 +1,102 @@
+package impl
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DiskBlobStorage implements core.BlobStorage with a file per blob, in a single directory. It is shared by the
+// instances only if the directory is.
+type DiskBlobStorage struct {
+	dir string
+}
+
+// NewDiskBlobStorage creates the directory if it doesn't exist yet
+func NewDiskBlobStorage(dir string) (*DiskBlobStorage, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &DiskBlobStorage{
+		dir: dir,
+	}, nil
+}
+
+func (d *DiskBlobStorage) path(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return "", fmt.Errorf("invalid blob ID: %q", id)
+	}
+	return filepath.Join(d.dir, id), nil
+}
+
+func (d *DiskBlobStorage) StoreBlob(id string, content io.Reader) (int64, error) {
+	path, err := d.path(id)
+	if err != nil {
+		return 0, err
+	}
+
+	// Written aside first, so that a blob is never seen half written
+	file, err := os.CreateTemp(d.dir, ".spool-*")
+	if err != nil {
+		return 0, err
+	}
+	size, err := io.Copy(file, content)
+	if err == nil {
+		err = file.Close()
+	} else {
+		_ = file.Close()
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return 0, err
+	}
+	return size, nil
+}
+
+func (d *DiskBlobStorage) OpenBlob(id string) (io.ReadCloser, error) {
+	path, err := d.path(id)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (d *DiskBlobStorage) DeleteBlob(id string) error {
+	path, err := d.path(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (d *DiskBlobStorage) ListBlobs(before time.Time) ([]string, error) {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || !info.ModTime().Before(before) {
+			continue
+		}
+		if strings.HasPrefix(entry.Name(), ".") {
+			// Left over by a crash, nothing takes that long to be written
+			if err := os.Remove(filepath.Join(d.dir, entry.Name())); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			continue
+		}
+		ids = append(ids, entry.Name())
+	}
+	return ids, nil
+}
@@ -2,34 +2,68 @@ package impl
 
 import (
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
-	"github.com/eliezedeck/gobase/random"
 	"github.com/eliezedeck/webhook-ingestor/core"
 )
 
-// MemoryStorage implements both ConfigStorage and RequestsStorage
+// MemoryStorage implements both ConfigStorage and RequestsStorage. Pending deliveries are only kept as long as the
+// process lives, this is a best effort.
+//
+// It is safe for concurrent use. The Requests are copied in and out, so that callers never share them with the
+// storage.
 type MemoryStorage struct {
+	mu sync.RWMutex
+
 	webhooks     []*core.Webhook
 	webhooksById map[string]*core.Webhook
-	requests     []*core.Request
-	requestsById map[string]*core.Request
+
+	requests    *requestBuffer
+	deadLetters *requestBuffer
+
+	// attempts are by Request ID, they are dropped along with their Request by PurgeExpiredRequests
+	attempts map[string][]*core.DeliveryAttempt
+
+	idempotencyRecords map[string]*core.IdempotencyRecord
 }
 
+// NewMemoryStorage returns a MemoryStorage without any limit
 func NewMemoryStorage() *MemoryStorage {
+	return NewBoundedMemoryStorage(0, 0)
+}
+
+// NewBoundedMemoryStorage returns a MemoryStorage that keeps at most `maxRequests` Requests, totalling at most
+// `maxBytes`, by evicting the oldest ones; except the pending ones, which are kept beyond the limits if need be. The
+// dead letters are bounded separately, with the same limits. A limit of 0 means unlimited.
+func NewBoundedMemoryStorage(maxRequests int, maxBytes int64) *MemoryStorage {
 	return &MemoryStorage{
 		webhooks:     make([]*core.Webhook, 0, 16),
 		webhooksById: make(map[string]*core.Webhook, 16),
-		requests:     make([]*core.Request, 0, 256),
-		requestsById: make(map[string]*core.Request, 256),
+
+		requests:    newRequestBuffer("requests", maxRequests, maxBytes),
+		deadLetters: newRequestBuffer("deadLetters", maxRequests, maxBytes),
+
+		attempts: make(map[string][]*core.DeliveryAttempt, 256),
+
+		idempotencyRecords: make(map[string]*core.IdempotencyRecord, 256),
 	}
 }
 
 func (m *MemoryStorage) GetAllWebhooks() ([]*core.Webhook, error) {
-	return m.webhooks, nil
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	webhooks := make([]*core.Webhook, len(m.webhooks))
+	copy(webhooks, m.webhooks)
+	return webhooks, nil
 }
 
 func (m *MemoryStorage) GetWebhook(id string) (*core.Webhook, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	if w, ok := m.webhooksById[id]; ok {
 		return w, nil
 	}
@@ -37,6 +71,9 @@ func (m *MemoryStorage) GetWebhook(id string) (*core.Webhook, error) {
 }
 
 func (m *MemoryStorage) AddWebhook(webhook *core.Webhook) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	webhook.Enabled = 1
 	m.webhooks = append(m.webhooks, webhook)
 	m.webhooksById[webhook.ID] = webhook
@@ -44,9 +81,11 @@ func (m *MemoryStorage) AddWebhook(webhook *core.Webhook) error {
 }
 
 func (m *MemoryStorage) RemoveWebhook(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	for i, w := range m.webhooks {
 		if w.ID == id {
-			w.Enabled = 0
 			m.webhooks = append(m.webhooks[:i], m.webhooks[i+1:]...)
 			delete(m.webhooksById, id)
 			return nil
@@ -56,27 +95,43 @@ func (m *MemoryStorage) RemoveWebhook(id string) error {
 }
 
 func (m *MemoryStorage) UpdateWebhook(webhook *core.Webhook) error {
-	if w, ok := m.webhooksById[webhook.ID]; ok {
-		// Disallow mutation of the following fields
-		if w.Path != webhook.Path {
-			return fmt.Errorf("cannot change Webhook Path")
-		}
-		if w.Method != webhook.Method {
-			return fmt.Errorf("cannot change Webhook Method")
-		}
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-		w.Name = webhook.Name
-		w.Enabled = webhook.Enabled
+	if w, ok := m.webhooksById[webhook.ID]; ok {
+		// Work on a copy, the current version may still be in use by readers. The Webhook is routed again by the
+		// caller when its Method or Path changes.
+		updated := *w
+		updated.Name = webhook.Name
+		updated.Method = webhook.Method
+		updated.Path = webhook.Path
+		updated.Enabled = webhook.Enabled
+		updated.Verification = webhook.Verification
+		updated.Retention = webhook.Retention
+		updated.Acknowledge = webhook.Acknowledge
+		updated.Handshakes = webhook.Handshakes
+		updated.Deduplication = webhook.Deduplication
+		updated.Access = webhook.Access
+		updated.MaxBodySize = webhook.MaxBodySize
+		updated.DecompressBodies = webhook.DecompressBodies
+		updated.Source = webhook.Source
 
 		// Update each of the Forward URLs
 		for _, f := range webhook.ForwardUrls {
 			if f.ID == "" {
 				// New forward URL
-				f.ID = random.String(8)
+				f.ID = core.RandomString(8)
 			}
 		}
-		w.ForwardUrls = webhook.ForwardUrls
+		updated.ForwardUrls = webhook.ForwardUrls
 
+		for i, ww := range m.webhooks {
+			if ww == w {
+				m.webhooks[i] = &updated
+				break
+			}
+		}
+		m.webhooksById[webhook.ID] = &updated
 		return nil
 	}
 	return fmt.Errorf("webhook with id %s not found", webhook.ID)
@@ -86,60 +141,282 @@ func (m *MemoryStorage) StoreRequest(request *core.Request) error {
 	if request.CreatedAt.IsZero() {
 		request.CreatedAt = time.Now()
 	}
-	m.requests = append(m.requests, request)
-	m.requestsById[request.ID] = request
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests.add(cloneRequest(request))
 	return nil
 }
 
+func (m *MemoryStorage) UpdateRequest(request *core.Request) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.requests.replace(cloneRequest(request))
+}
+
 func (m *MemoryStorage) GetOldestRequests(count int) ([]*core.Request, error) {
-	if count == 0 {
-		return nil, nil
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.requests.list(count, false, nil), nil
+}
+
+func (m *MemoryStorage) GetNewestRequests(count int) ([]*core.Request, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.requests.list(count, true, nil), nil
+}
+
+func (m *MemoryStorage) GetRequest(id string) (*core.Request, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if r, ok := m.requests.byId[id]; ok {
+		return cloneRequest(r), nil
 	}
+	return nil, nil
+}
 
-	result := make([]*core.Request, 0, count)
-	for i := len(m.requests) - 1; i >= 0; i-- {
-		result = append(result, m.requests[i])
-		if len(result) == count {
-			break
+func (m *MemoryStorage) QueryRequests(query *core.RequestQuery) ([]*core.Request, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	matches := make([]*core.Request, 0, query.Limit)
+	for _, r := range m.requests.items {
+		if query.Matches(r) {
+			matches = append(matches, r)
 		}
 	}
+	sort.Slice(matches, func(i, j int) bool {
+		return query.Less(matches[i].CreatedAt, matches[i].ID, matches[j].CreatedAt, matches[j].ID)
+	})
+	if len(matches) > query.Limit {
+		matches = matches[:query.Limit]
+	}
 
-	return m.requests, nil
+	result := make([]*core.Request, len(matches))
+	for i, r := range matches {
+		result[i] = cloneRequest(r)
+	}
+	return result, nil
 }
 
-func (m *MemoryStorage) GetNewestRequests(count int) ([]*core.Request, error) {
-	if count == 0 {
-		return nil, nil
+func (m *MemoryStorage) DeleteRequest(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.requests.remove(id) {
+		return fmt.Errorf("request with id %s not found", id)
+	}
+	return nil
+}
+
+func (m *MemoryStorage) CountPendingRequests() (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	count := 0
+	for _, r := range m.requests.items {
+		if r.Status == core.RequestStatusPending {
+			count++
+		}
 	}
+	return count, nil
+}
+
+func (m *MemoryStorage) ClaimPendingRequests(now time.Time, lease time.Duration, count int) ([]*core.Request, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
 	result := make([]*core.Request, 0, count)
-	for _, r := range m.requests {
-		result = append(result, r)
+	for _, r := range m.requests.items {
 		if len(result) == count {
 			break
 		}
+		if r.Status != core.RequestStatusPending || r.NextAttemptAt.After(now) || r.LockedUntil.After(now) {
+			continue
+		}
+		r.LockedUntil = now.Add(lease)
+		result = append(result, cloneRequest(r))
 	}
+	return result, nil
+}
 
+func (m *MemoryStorage) MoveToDeadLetters(request *core.Request) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deadLetters.add(cloneRequest(request))
+	m.requests.remove(request.ID)
+	return nil
+}
+
+func (m *MemoryStorage) GetDeadLetters(filter core.DeadLetterFilter, count int) ([]*core.Request, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// Newest first
+	return m.deadLetters.list(count, true, filter.Matches), nil
+}
+
+func (m *MemoryStorage) GetDeadLetter(id string) (*core.Request, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if r, ok := m.deadLetters.byId[id]; ok {
+		return cloneRequest(r), nil
+	}
+	return nil, nil
+}
+
+func (m *MemoryStorage) DeleteDeadLetter(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.deadLetters.remove(id) {
+		return fmt.Errorf("dead letter with id %s not found", id)
+	}
+	return nil
+}
+
+func (m *MemoryStorage) PurgeDeadLetters(filter core.DeadLetterFilter) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.deadLetters.purge(filter.Matches), nil
+}
+
+func (m *MemoryStorage) StoreDeliveryAttempt(attempt *core.DeliveryAttempt) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	clone := *attempt
+	m.attempts[attempt.RequestId] = append(m.attempts[attempt.RequestId], &clone)
+	return nil
+}
+
+func (m *MemoryStorage) GetDeliveryAttempts(requestId string) ([]*core.DeliveryAttempt, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	attempts := m.attempts[requestId]
+	result := make([]*core.DeliveryAttempt, len(attempts))
+	for i, a := range attempts {
+		clone := *a
+		result[i] = &clone
+	}
 	return result, nil
 }
 
-func (m *MemoryStorage) GetRequest(id string) (*core.Request, error) {
-	if r, ok := m.requestsById[id]; ok {
-		return r, nil
+func (m *MemoryStorage) DeleteDeliveryAttempts(requestId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.attempts, requestId)
+	return nil
+}
+
+func (m *MemoryStorage) ClaimIdempotencyKey(record *core.IdempotencyRecord, now time.Time) (*core.IdempotencyRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if existing, ok := m.idempotencyRecords[record.ID]; ok && existing.Holds(now) {
+		clone := *existing
+		return &clone, nil
 	}
+	clone := *record
+	m.idempotencyRecords[record.ID] = &clone
 	return nil, nil
 }
 
-func (m *MemoryStorage) DeleteRequest(id string) error {
-	if _, ok := m.requestsById[id]; ok {
-		delete(m.requestsById, id)
-		for i, rr := range m.requests {
-			if rr.ID == id {
-				m.requests = append(m.requests[:i], m.requests[i+1:]...)
-				break
+func (m *MemoryStorage) CompleteIdempotencyKey(record *core.IdempotencyRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.idempotencyRecords[record.ID]
+	if !ok {
+		return fmt.Errorf("idempotency record with id %s not found", record.ID)
+	}
+	if existing.RequestId != record.RequestId {
+		return nil // taken over
+	}
+	clone := *record
+	m.idempotencyRecords[record.ID] = &clone
+	return nil
+}
+
+func (m *MemoryStorage) ReleaseIdempotencyKey(record *core.IdempotencyRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if existing, ok := m.idempotencyRecords[record.ID]; ok && existing.RequestId == record.RequestId {
+		delete(m.idempotencyRecords, record.ID)
+	}
+	return nil
+}
+
+func (m *MemoryStorage) PurgeExpiredRequests(now time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expired := func(r *core.Request) bool {
+		return !r.ExpiresAt.IsZero() && !r.ExpiresAt.After(now)
+	}
+	purged := m.requests.purge(expired) + m.deadLetters.purge(expired)
+
+	// The DeliveryAttempts of the evicted and purged Requests go away as well, so that they don't pile up
+	for requestId, attempts := range m.attempts {
+		_, stored := m.requests.byId[requestId]
+		_, deadLetter := m.deadLetters.byId[requestId]
+		if !stored && !deadLetter {
+			delete(m.attempts, requestId)
+			continue
+		}
+
+		kept := attempts[:0]
+		for _, a := range attempts {
+			if a.ExpiresAt.IsZero() || a.ExpiresAt.After(now) {
+				kept = append(kept, a)
 			}
 		}
-		return nil
+		m.attempts[requestId] = kept
+	}
+
+	for id, record := range m.idempotencyRecords {
+		if !record.ExpiresAt.After(now) {
+			delete(m.idempotencyRecords, id)
+		}
+	}
+	return purged, nil
+}
+
+func (m *MemoryStorage) TrimRequests(webhookId string, keep int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Skip the `keep` newest ones, then purge the rest
+	seen := 0
+	excess := make(map[string]bool)
+	for i := len(m.requests.items) - 1; i >= 0; i-- {
+		r := m.requests.items[i]
+		if r.FromWebhookId != webhookId || r.Status == core.RequestStatusPending {
+			continue
+		}
+		seen++
+		if seen > keep {
+			excess[r.ID] = true
+		}
+	}
+	if len(excess) == 0 {
+		return 0, nil
+	}
+	for id := range excess {
+		delete(m.attempts, id)
 	}
-	return fmt.Errorf("request with id %s not found", id)
+	return m.requests.purge(func(r *core.Request) bool {
+		return excess[r.ID]
+	}), nil
 }
@@ -0,0 +1,190 @@
+package impl
+
+import (
+	"fmt"
+
+	"github.com/eliezedeck/gobase/logging"
+	"github.com/eliezedeck/webhook-ingestor/core"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+var metricEvictedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "webhook_ingestor",
+	Name:      "memory_evicted_requests_total",
+	Help:      "Requests evicted by the memory storage to stay within its limits, by buffer: requests or dead letters.",
+}, []string{"buffer"})
+
+// requestBuffer keeps Requests in insertion order. Like a ring buffer, the oldest Requests are evicted once any of its
+// limits is exceeded; a limit of 0 means unlimited. The pending Requests are never evicted, they would never be
+// delivered otherwise: the limits are exceeded when they are all that is left. It is not safe for concurrent use on its
+// own.
+type requestBuffer struct {
+	name     string
+	items    []*core.Request
+	byId     map[string]*core.Request
+	bytes    int64
+	maxCount int
+	maxBytes int64
+
+	// overflowing is set while only pending Requests are left beyond the limits, so that it is only warned once
+	overflowing bool
+}
+
+func newRequestBuffer(name string, maxCount int, maxBytes int64) *requestBuffer {
+	return &requestBuffer{
+		name:     name,
+		items:    make([]*core.Request, 0, 256),
+		byId:     make(map[string]*core.Request, 256),
+		maxCount: maxCount,
+		maxBytes: maxBytes,
+	}
+}
+
+// requestSize is an estimate of the memory used by a Request, only its variable parts are counted
+func requestSize(r *core.Request) int64 {
+	size := int64(len(r.ID) + len(r.Method) + len(r.Path) + len(r.Query) + len(r.Body) + len(r.FromWebhookId) + len(r.Rejection))
+	for key, values := range r.Headers {
+		size += int64(len(key))
+		for _, v := range values {
+			size += int64(len(v))
+		}
+	}
+	for _, a := range r.Attempts {
+		size += int64(len(a.Error)) + 32
+	}
+	return size
+}
+
+// cloneRequest makes a copy that can be handed out without sharing the mutable parts of the Request
+func cloneRequest(r *core.Request) *core.Request {
+	clone := *r
+	if r.Attempts != nil {
+		clone.Attempts = make([]*core.Attempt, len(r.Attempts))
+		for i, a := range r.Attempts {
+			attempt := *a
+			clone.Attempts[i] = &attempt
+		}
+	}
+	return &clone
+}
+
+func (b *requestBuffer) add(r *core.Request) {
+	if existing, ok := b.byId[r.ID]; ok {
+		b.remove(existing.ID)
+	}
+	b.items = append(b.items, r)
+	b.byId[r.ID] = r
+	b.bytes += requestSize(r)
+	b.evict()
+}
+
+func (b *requestBuffer) exceeds(count int) bool {
+	return (b.maxCount > 0 && count > b.maxCount) || (b.maxBytes > 0 && b.bytes > b.maxBytes)
+}
+
+// evict drops the oldest Requests that are not pending, until the buffer is within its limits
+func (b *requestBuffer) evict() {
+	count := len(b.items)
+	if !b.exceeds(count) {
+		b.overflowing = false
+		return
+	}
+
+	kept := b.items[:0]
+	for _, r := range b.items {
+		if r.Status == core.RequestStatusPending || !b.exceeds(count) {
+			kept = append(kept, r)
+			continue
+		}
+		delete(b.byId, r.ID)
+		b.bytes -= requestSize(r)
+		count--
+		metricEvictedRequests.WithLabelValues(b.name).Inc()
+		logging.L.Debug("Request has been evicted from the memory storage", zap.String("buffer", b.name),
+			zap.String("id", r.ID), zap.String("status", r.Status))
+	}
+	for i := len(kept); i < len(b.items); i++ {
+		b.items[i] = nil
+	}
+	b.items = kept
+
+	if b.exceeds(count) && !b.overflowing {
+		logging.L.Warn("Memory storage is over its limits, only pending requests are left to evict",
+			zap.String("buffer", b.name), zap.Int("count", count), zap.Int64("bytes", b.bytes))
+	}
+	b.overflowing = b.exceeds(count)
+}
+
+func (b *requestBuffer) replace(r *core.Request) error {
+	existing, ok := b.byId[r.ID]
+	if !ok {
+		return fmt.Errorf("request with id %s not found", r.ID)
+	}
+	for i, rr := range b.items {
+		if rr == existing {
+			b.items[i] = r
+			break
+		}
+	}
+	b.byId[r.ID] = r
+	b.bytes += requestSize(r) - requestSize(existing)
+	b.evict()
+	return nil
+}
+
+func (b *requestBuffer) remove(id string) bool {
+	existing, ok := b.byId[id]
+	if !ok {
+		return false
+	}
+	delete(b.byId, id)
+	for i, rr := range b.items {
+		if rr == existing {
+			b.items = append(b.items[:i], b.items[i+1:]...)
+			break
+		}
+	}
+	b.bytes -= requestSize(existing)
+	return true
+}
+
+// list returns clones of up to `count` Requests matching the filter (nil matches everything), newest or oldest first
+func (b *requestBuffer) list(count int, newestFirst bool, filter func(*core.Request) bool) []*core.Request {
+	if count == 0 {
+		return nil
+	}
+
+	result := make([]*core.Request, 0, count)
+	for i := range b.items {
+		r := b.items[i]
+		if newestFirst {
+			r = b.items[len(b.items)-1-i]
+		}
+		if filter != nil && !filter(r) {
+			continue
+		}
+		result = append(result, cloneRequest(r))
+		if len(result) == count {
+			break
+		}
+	}
+	return result
+}
+
+// purge removes all the Requests matching the filter, returns how many were removed
+func (b *requestBuffer) purge(filter func(*core.Request) bool) int {
+	kept := make([]*core.Request, 0, len(b.items))
+	for _, r := range b.items {
+		if filter(r) {
+			delete(b.byId, r.ID)
+			b.bytes -= requestSize(r)
+		} else {
+			kept = append(kept, r)
+		}
+	}
+	purged := len(b.items) - len(kept)
+	b.items = kept
+	return purged
+}
@@ -0,0 +1,192 @@
+package impl
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eliezedeck/gobase/logging"
+	"github.com/eliezedeck/webhook-ingestor/core"
+	"github.com/eliezedeck/webhook-ingestor/impl/storagetest"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	logging.L = zap.NewNop()
+	os.Exit(m.Run())
+}
+
+func TestMemoryStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Storage {
+		return NewMemoryStorage()
+	})
+}
+
+// checkBuffer verifies that the bookkeeping of the buffer matches its Requests
+func checkBuffer(t *testing.T, b *requestBuffer) {
+	t.Helper()
+	if len(b.items) != len(b.byId) {
+		t.Errorf("%d items but %d by ID", len(b.items), len(b.byId))
+	}
+	var size int64
+	for _, r := range b.items {
+		if b.byId[r.ID] != r {
+			t.Errorf("request %s is not indexed", r.ID)
+		}
+		size += requestSize(r)
+	}
+	if size != b.bytes {
+		t.Errorf("bytes = %d, want %d", b.bytes, size)
+	}
+	if b.exceeds(len(b.items)) {
+		// Only the pending ones may be kept beyond the limits
+		for _, r := range b.items {
+			if r.Status != core.RequestStatusPending {
+				t.Errorf("%d items and %d bytes, beyond the limits with %s %s", len(b.items), b.bytes, r.Status, r.ID)
+				break
+			}
+		}
+	}
+}
+
+func TestMemoryStorageEviction(t *testing.T) {
+	storage := NewBoundedMemoryStorage(2, 0)
+	start := time.Now()
+	store := func(id, status string) {
+		request := storagetest.NewRequest(id, "w-1", start)
+		request.Status = status
+		if err := storage.StoreRequest(request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stored := func() string {
+		requests, err := storage.GetOldestRequests(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := ""
+		for _, r := range requests {
+			ids += r.ID + " "
+		}
+		return ids
+	}
+
+	store("r-1", core.RequestStatusPending)
+	store("r-2", core.RequestStatusDelivered)
+	store("r-3", core.RequestStatusPending)
+	if ids := stored(); ids != "r-1 r-3 " {
+		t.Errorf("requests = %s, want the pending ones r-1 r-3", ids)
+	}
+	store("r-4", core.RequestStatusPending)
+	if ids := stored(); ids != "r-1 r-3 r-4 " {
+		t.Errorf("requests = %s, want all the pending ones r-1 r-3 r-4", ids)
+	}
+
+	// Once delivered, they can go
+	request, _ := storage.GetRequest("r-1")
+	request.Status = core.RequestStatusDelivered
+	if err := storage.UpdateRequest(request); err != nil {
+		t.Fatal(err)
+	}
+	if ids := stored(); ids != "r-3 r-4 " {
+		t.Errorf("requests = %s, want r-3 r-4", ids)
+	}
+	checkBuffer(t, storage.requests)
+}
+
+// TestMemoryStorageConcurrency is meant to be run with -race
+func TestMemoryStorageConcurrency(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxRequests int
+		maxBytes    int64
+	}{
+		{"unbounded", 0, 0},
+		{"by count", 50, 0},
+		{"by bytes", 0, 4096},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := NewBoundedMemoryStorage(tt.maxRequests, tt.maxBytes)
+			start := time.Now()
+
+			const workers = 8
+			const rounds = 200
+			var wg sync.WaitGroup
+			run := func(f func(w, i int)) {
+				for w := 0; w < workers; w++ {
+					wg.Add(1)
+					go func(w int) {
+						defer wg.Done()
+						for i := 0; i < rounds; i++ {
+							f(w, i)
+						}
+					}(w)
+				}
+			}
+
+			// Writers
+			run(func(w, i int) {
+				request := storagetest.NewRequest(fmt.Sprintf("r-%d-%d", w, i), "w-1", start)
+				request.ExpiresAt = start.Add(time.Duration(i%3) * time.Millisecond)
+				if err := storage.StoreRequest(request); err != nil {
+					t.Error(err)
+				}
+			})
+			// Readers, that scribble on what they get
+			run(func(w, i int) {
+				newest, _ := storage.GetNewestRequests(20)
+				oldest, _ := storage.GetOldestRequests(20)
+				for _, r := range append(newest, oldest...) {
+					r.Status = core.RequestStatusDelivered
+					r.Attempts = append(r.Attempts, &core.Attempt{At: start})
+				}
+				queried, err := storage.QueryRequests(&core.RequestQuery{WebhookId: "w-1", Status: core.RequestStatusPending, Limit: 20})
+				if err != nil {
+					t.Error(err)
+				}
+				for _, r := range queried {
+					r.LockedUntil = start
+				}
+			})
+			// Deliveries
+			run(func(w, i int) {
+				claimed, err := storage.ClaimPendingRequests(start.Add(time.Duration(i)*time.Second), time.Second, 5)
+				if err != nil {
+					t.Error(err)
+				}
+				for j, r := range claimed {
+					r.Attempts = append(r.Attempts, &core.Attempt{At: start, StatusCode: 500, Error: "failed"})
+					r.NextAttemptAt = start.Add(time.Minute)
+					if j%2 == 0 {
+						// Evicted or purged in the meantime otherwise
+						_ = storage.UpdateRequest(r)
+					} else {
+						_ = storage.DeleteRequest(r.ID)
+					}
+				}
+			})
+			// Retention
+			run(func(w, i int) {
+				if _, err := storage.PurgeExpiredRequests(start.Add(time.Duration(i%3) * time.Millisecond)); err != nil {
+					t.Error(err)
+				}
+				if _, err := storage.CountPendingRequests(); err != nil {
+					t.Error(err)
+				}
+			})
+			wg.Wait()
+
+			storage.mu.RLock()
+			defer storage.mu.RUnlock()
+			checkBuffer(t, storage.requests)
+			for _, r := range storage.requests.items {
+				if r.Status != core.RequestStatusPending {
+					t.Errorf("request %s has been changed from outside: %s", r.ID, r.Status)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package mongodbimpl
+
+import (
+	"context"
+
+	"github.com/eliezedeck/webhook-ingestor/core"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func (m *Storage) StoreDeliveryAttempt(attempt *core.DeliveryAttempt) error {
+	_, err := m.collDeliveryAttempts.InsertOne(context.Background(), attempt)
+	return err
+}
+
+func (m *Storage) GetDeliveryAttempts(requestId string) ([]*core.DeliveryAttempt, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "startedAt", Value: OrderASC}})
+	cur, err := m.collDeliveryAttempts.Find(context.Background(), bson.D{{Key: "requestId", Value: requestId}}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	attempts := make([]*core.DeliveryAttempt, 0, 4)
+	if err := cur.All(context.Background(), &attempts); err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
+
+func (m *Storage) DeleteDeliveryAttempts(requestId string) error {
+	_, err := m.collDeliveryAttempts.DeleteMany(context.Background(), bson.D{{Key: "requestId", Value: requestId}})
+	return err
+}
@@ -0,0 +1,66 @@
+package mongodbimpl
+
+import (
+	"context"
+
+	"github.com/eliezedeck/webhook-ingestor/core"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func deadLetterFilter(filter core.DeadLetterFilter) bson.D {
+	f := bson.D{}
+	if filter.WebhookId != "" {
+		f = append(f, bson.E{Key: "fromWebhookId", Value: filter.WebhookId})
+	}
+	if filter.ForwardUrlId != "" {
+		f = append(f, bson.E{Key: "forwardUrl._id", Value: filter.ForwardUrlId})
+	}
+	return f
+}
+
+func (m *Storage) MoveToDeadLetters(request *core.Request) error {
+	// Insert first, so that the Request can't get lost in between
+	if _, err := m.collDeadLetters.InsertOne(context.Background(), request); err != nil {
+		return err
+	}
+	_, err := m.collRequests.DeleteOne(context.Background(), bson.D{{Key: "_id", Value: request.ID}})
+	return err
+}
+
+func (m *Storage) GetDeadLetters(filter core.DeadLetterFilter, count int) ([]*core.Request, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: OrderDESC}}).SetLimit(int64(count))
+	cur, err := m.collDeadLetters.Find(context.Background(), deadLetterFilter(filter), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	requests := make([]*core.Request, 0, count)
+	if err := cur.All(context.Background(), &requests); err != nil {
+		return nil, err
+	}
+	return requests, err
+}
+
+func (m *Storage) GetDeadLetter(id string) (*core.Request, error) {
+	var request core.Request
+	err := m.collDeadLetters.FindOne(context.Background(), bson.D{{Key: "_id", Value: id}}).Decode(&request)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return &request, err
+}
+
+func (m *Storage) DeleteDeadLetter(id string) error {
+	_, err := m.collDeadLetters.DeleteOne(context.Background(), bson.D{{Key: "_id", Value: id}})
+	return err
+}
+
+func (m *Storage) PurgeDeadLetters(filter core.DeadLetterFilter) (int, error) {
+	result, err := m.collDeadLetters.DeleteMany(context.Background(), deadLetterFilter(filter))
+	if err != nil {
+		return 0, err
+	}
+	return int(result.DeletedCount), nil
+}
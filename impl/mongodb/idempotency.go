@@ -0,0 +1,66 @@
+package mongodbimpl
+
+import (
+	"context"
+	"time"
+
+	"github.com/eliezedeck/webhook-ingestor/core"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func (m *Storage) ClaimIdempotencyKey(record *core.IdempotencyRecord, now time.Time) (*core.IdempotencyRecord, error) {
+	ctx := context.Background()
+	_, err := m.collIdempotencyKeys.InsertOne(ctx, record)
+	if err == nil {
+		return nil, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return nil, err
+	}
+
+	// Take over a record that doesn't hold anymore: the TTL index only runs every minute or so, and the lease of the
+	// original call may have run out
+	filter := bson.D{
+		{Key: "_id", Value: record.ID},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "expiresAt", Value: bson.D{{Key: "$lte", Value: now}}}},
+			bson.D{
+				{Key: "statusCode", Value: 0},
+				{Key: "lockedUntil", Value: bson.D{{Key: "$lte", Value: now}}},
+			},
+		}},
+	}
+	result, err := m.collIdempotencyKeys.ReplaceOne(ctx, filter, record)
+	if err != nil {
+		return nil, err
+	}
+	if result.MatchedCount == 1 {
+		return nil, nil
+	}
+
+	existing := &core.IdempotencyRecord{}
+	if err := m.collIdempotencyKeys.FindOne(ctx, bson.D{{Key: "_id", Value: record.ID}}).Decode(existing); err != nil {
+		if err == mongo.ErrNoDocuments {
+			// Released in the meantime, try again
+			return m.ClaimIdempotencyKey(record, now)
+		}
+		return nil, err
+	}
+	return existing, nil
+}
+
+func (m *Storage) CompleteIdempotencyKey(record *core.IdempotencyRecord) error {
+	_, err := m.collIdempotencyKeys.ReplaceOne(context.Background(), idempotencyClaim(record), record)
+	return err
+}
+
+func (m *Storage) ReleaseIdempotencyKey(record *core.IdempotencyRecord) error {
+	_, err := m.collIdempotencyKeys.DeleteOne(context.Background(), idempotencyClaim(record))
+	return err
+}
+
+// idempotencyClaim matches the record as long as it hasn't been taken over by another call
+func idempotencyClaim(record *core.IdempotencyRecord) bson.D {
+	return bson.D{{Key: "_id", Value: record.ID}, {Key: "requestId", Value: record.RequestId}}
+}
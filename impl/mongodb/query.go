@@ -0,0 +1,73 @@
+package mongodbimpl
+
+import (
+	"context"
+	"regexp"
+
+	"github.com/eliezedeck/webhook-ingestor/core"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func (m *Storage) QueryRequests(query *core.RequestQuery) ([]*core.Request, error) {
+	filter := bson.D{}
+	if query.WebhookId != "" {
+		filter = append(filter, bson.E{Key: "fromWebhookId", Value: query.WebhookId})
+	}
+	if query.ForwardUrlId != "" {
+		filter = append(filter, bson.E{Key: "forwardUrl._id", Value: query.ForwardUrlId})
+	}
+	if query.Method != "" {
+		filter = append(filter, bson.E{Key: "method", Value: query.Method})
+	}
+	if query.PathPrefix != "" {
+		// Anchored, so that it can make use of an index
+		filter = append(filter, bson.E{Key: "path", Value: primitive.Regex{Pattern: "^" + regexp.QuoteMeta(query.PathPrefix)}})
+	}
+	if query.Header != "" {
+		filter = append(filter, bson.E{Key: "headers." + query.CanonicalHeader(), Value: query.HeaderValue})
+	}
+	if query.Status != "" {
+		filter = append(filter, bson.E{Key: "status", Value: query.Status})
+	}
+
+	createdAt := bson.D{}
+	if !query.Since.IsZero() {
+		createdAt = append(createdAt, bson.E{Key: "$gte", Value: query.Since})
+	}
+	if !query.Until.IsZero() {
+		createdAt = append(createdAt, bson.E{Key: "$lt", Value: query.Until})
+	}
+	if len(createdAt) > 0 {
+		filter = append(filter, bson.E{Key: "createdAt", Value: createdAt})
+	}
+
+	order, op := OrderASC, "$gt"
+	if query.NewestFirst {
+		order, op = OrderDESC, "$lt"
+	}
+	if query.After != nil {
+		filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+			bson.D{{Key: "createdAt", Value: bson.D{{Key: op, Value: query.After.CreatedAt}}}},
+			bson.D{
+				{Key: "createdAt", Value: query.After.CreatedAt},
+				{Key: "_id", Value: bson.D{{Key: op, Value: query.After.ID}}},
+			},
+		}})
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "createdAt", Value: order}, {Key: "_id", Value: order}}).
+		SetLimit(int64(query.Limit))
+	cur, err := m.collRequests.Find(context.Background(), filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	requests := make([]*core.Request, 0, query.Limit)
+	if err := cur.All(context.Background(), &requests); err != nil {
+		return nil, err
+	}
+	return requests, err
+}
@@ -2,6 +2,7 @@ package mongodbimpl
 
 import (
 	"context"
+	"time"
 
 	"github.com/eliezedeck/webhook-ingestor/core"
 	"go.mongodb.org/mongo-driver/bson"
@@ -15,8 +16,13 @@ func (m *Storage) StoreRequest(request *core.Request) error {
 	return err
 }
 
+func (m *Storage) UpdateRequest(request *core.Request) error {
+	_, err := m.collRequests.ReplaceOne(context.Background(), bson.D{{Key: "_id", Value: request.ID}}, request)
+	return err
+}
+
 func (m *Storage) GetOldestRequests(count int) ([]*core.Request, error) {
-	opts := options.Find().SetSort(bson.D{{"createdAt", OrderASC}}).SetLimit(int64(count))
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: OrderASC}}).SetLimit(int64(count))
 	cur, err := m.collRequests.Find(context.Background(), bson.D{}, opts)
 	if err != nil {
 		return nil, err
@@ -30,7 +36,7 @@ func (m *Storage) GetOldestRequests(count int) ([]*core.Request, error) {
 }
 
 func (m *Storage) GetNewestRequests(count int) ([]*core.Request, error) {
-	opts := options.Find().SetSort(bson.D{{"createdAt", OrderDESC}}).SetLimit(int64(count))
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: OrderDESC}}).SetLimit(int64(count))
 	cur, err := m.collRequests.Find(context.Background(), bson.D{}, opts)
 	if err != nil {
 		return nil, err
@@ -45,7 +51,7 @@ func (m *Storage) GetNewestRequests(count int) ([]*core.Request, error) {
 
 func (m *Storage) GetRequest(id string) (*core.Request, error) {
 	var request core.Request
-	err := m.collRequests.FindOne(context.Background(), bson.D{{"_id", id}}).Decode(&request)
+	err := m.collRequests.FindOne(context.Background(), bson.D{{Key: "_id", Value: id}}).Decode(&request)
 	if err == mongo.ErrNoDocuments {
 		return nil, nil
 	}
@@ -53,6 +59,38 @@ func (m *Storage) GetRequest(id string) (*core.Request, error) {
 }
 
 func (m *Storage) DeleteRequest(id string) error {
-	_, err := m.collRequests.DeleteOne(context.Background(), bson.D{{"_id", id}})
+	_, err := m.collRequests.DeleteOne(context.Background(), bson.D{{Key: "_id", Value: id}})
 	return err
 }
+
+func (m *Storage) CountPendingRequests() (int, error) {
+	count, err := m.collRequests.CountDocuments(context.Background(), bson.D{{Key: "status", Value: core.RequestStatusPending}})
+	return int(count), err
+}
+
+func (m *Storage) ClaimPendingRequests(now time.Time, lease time.Duration, count int) ([]*core.Request, error) {
+	filter := bson.D{
+		{Key: "status", Value: core.RequestStatusPending},
+		{Key: "nextAttemptAt", Value: bson.D{{Key: "$lte", Value: now}}},
+		{Key: "lockedUntil", Value: bson.D{{Key: "$lte", Value: now}}},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "lockedUntil", Value: now.Add(lease)}}}}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "nextAttemptAt", Value: OrderASC}}).
+		SetReturnDocument(options.After)
+
+	// Claim one by one, each claim is atomic so that concurrent instances never get the same Request
+	requests := make([]*core.Request, 0, count)
+	for len(requests) < count {
+		var request core.Request
+		err := m.collRequests.FindOneAndUpdate(context.Background(), filter, update, opts).Decode(&request)
+		if err == mongo.ErrNoDocuments {
+			break
+		}
+		if err != nil {
+			return requests, err
+		}
+		requests = append(requests, &request)
+	}
+	return requests, nil
+}
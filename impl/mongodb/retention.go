@@ -0,0 +1,60 @@
+package mongodbimpl
+
+import (
+	"context"
+	"time"
+
+	"github.com/eliezedeck/webhook-ingestor/core"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func (m *Storage) PurgeExpiredRequests(now time.Time) (int, error) {
+	// Nothing to do, the TTL indexes on `expiresAt` take care of that
+	return 0, nil
+}
+
+// ExpiresRequests tells that the TTL indexes delete the expired Requests, PurgeExpiredRequests doesn't count them
+func (m *Storage) ExpiresRequests() bool {
+	return true
+}
+
+func (m *Storage) TrimRequests(webhookId string, keep int) (int, error) {
+	filter := bson.D{
+		{Key: "fromWebhookId", Value: webhookId},
+		{Key: "status", Value: bson.D{{Key: "$ne", Value: core.RequestStatusPending}}},
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "createdAt", Value: OrderDESC}}).
+		SetSkip(int64(keep)).
+		SetProjection(bson.D{{Key: "_id", Value: 1}})
+	cur, err := m.collRequests.Find(context.Background(), filter, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	var excess []struct {
+		ID string `bson:"_id"`
+	}
+	if err := cur.All(context.Background(), &excess); err != nil {
+		return 0, err
+	}
+	if len(excess) == 0 {
+		return 0, nil
+	}
+
+	ids := make([]string, len(excess))
+	for i, e := range excess {
+		ids[i] = e.ID
+	}
+	result, err := m.collRequests.DeleteMany(context.Background(), bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}})
+	if err != nil {
+		return 0, err
+	}
+
+	// The DeliveryAttempts go along with their Request
+	if _, err := m.collDeliveryAttempts.DeleteMany(context.Background(), bson.D{{Key: "requestId", Value: bson.D{{Key: "$in", Value: ids}}}}); err != nil {
+		return int(result.DeletedCount), err
+	}
+	return int(result.DeletedCount), nil
+}
@@ -13,10 +13,13 @@ import (
 )
 
 type Storage struct {
-	client       *mongo.Client
-	db           *mongo.Database
-	collRequests *mongo.Collection
-	collWebhooks *mongo.Collection
+	client               *mongo.Client
+	db                   *mongo.Database
+	collRequests         *mongo.Collection
+	collDeadLetters      *mongo.Collection
+	collDeliveryAttempts *mongo.Collection
+	collIdempotencyKeys  *mongo.Collection
+	collWebhooks         *mongo.Collection
 }
 
 func NewStorage(uri, dbname string) (*Storage, error) {
@@ -45,6 +48,97 @@ func NewStorage(uri, dbname string) (*Storage, error) {
 	}, false); err != nil {
 		return nil, err
 	}
+	if err := setupIndex(collRequests, IndexDefinition{
+		Fields: []IndexField{
+			{Name: "status", Order: OrderASC},
+			{Name: "nextAttemptAt", Order: OrderASC},
+		},
+		Name: "pending",
+	}, false); err != nil {
+		return nil, err
+	}
+
+	if err := setupIndex(collRequests, IndexDefinition{
+		Fields: []IndexField{
+			{Name: "fromWebhookId", Order: OrderASC},
+			{Name: "createdAt", Order: OrderDESC},
+		},
+		Name: "webhook",
+	}, false); err != nil {
+		return nil, err
+	}
+
+	// The retention is enforced by MongoDB itself, each document has its own expiration date
+	expireAtDate := int32(0)
+	if err := setupIndex(collRequests, IndexDefinition{
+		Fields: []IndexField{
+			{Name: "expiresAt", Order: OrderASC},
+		},
+		Name:               "expiration",
+		ExpireAfterSeconds: &expireAtDate,
+	}, false); err != nil {
+		return nil, err
+	}
+
+	collDeadLetters := db.Collection("deadLetters")
+	if err := setupIndex(collDeadLetters, IndexDefinition{
+		Fields: []IndexField{
+			{Name: "createdAt", Order: OrderDESC},
+		},
+		Name: "date",
+	}, false); err != nil {
+		return nil, err
+	}
+	if err := setupIndex(collDeadLetters, IndexDefinition{
+		Fields: []IndexField{
+			{Name: "fromWebhookId", Order: OrderASC},
+			{Name: "forwardUrl._id", Order: OrderASC},
+			{Name: "createdAt", Order: OrderDESC},
+		},
+		Name: "origin",
+	}, false); err != nil {
+		return nil, err
+	}
+	if err := setupIndex(collDeadLetters, IndexDefinition{
+		Fields: []IndexField{
+			{Name: "expiresAt", Order: OrderASC},
+		},
+		Name:               "expiration",
+		ExpireAfterSeconds: &expireAtDate,
+	}, false); err != nil {
+		return nil, err
+	}
+
+	collDeliveryAttempts := db.Collection("deliveryAttempts")
+	if err := setupIndex(collDeliveryAttempts, IndexDefinition{
+		Fields: []IndexField{
+			{Name: "requestId", Order: OrderASC},
+			{Name: "startedAt", Order: OrderASC},
+		},
+		Name: "request",
+	}, false); err != nil {
+		return nil, err
+	}
+	if err := setupIndex(collDeliveryAttempts, IndexDefinition{
+		Fields: []IndexField{
+			{Name: "expiresAt", Order: OrderASC},
+		},
+		Name:               "expiration",
+		ExpireAfterSeconds: &expireAtDate,
+	}, false); err != nil {
+		return nil, err
+	}
+
+	collIdempotencyKeys := db.Collection("idempotencyKeys")
+	if err := setupIndex(collIdempotencyKeys, IndexDefinition{
+		Fields: []IndexField{
+			{Name: "expiresAt", Order: OrderASC},
+		},
+		Name:               "expiration",
+		ExpireAfterSeconds: &expireAtDate,
+	}, false); err != nil {
+		return nil, err
+	}
 
 	collWebhooks := db.Collection("webhooks")
 	if err := setupIndex(collWebhooks, IndexDefinition{
@@ -66,10 +160,13 @@ func NewStorage(uri, dbname string) (*Storage, error) {
 	logging.L.Info("Indexes are set up, database is ready")
 
 	return &Storage{
-		client:       client,
-		db:           db,
-		collRequests: collRequests,
-		collWebhooks: collWebhooks,
+		client:               client,
+		db:                   db,
+		collRequests:         collRequests,
+		collDeadLetters:      collDeadLetters,
+		collDeliveryAttempts: collDeliveryAttempts,
+		collIdempotencyKeys:  collIdempotencyKeys,
+		collWebhooks:         collWebhooks,
 	}, nil
 }
 
@@ -87,6 +184,9 @@ type IndexDefinition struct {
 	Fields []IndexField
 	// Name of the index, it is automatically suffixed with "Idx" so no need to add that
 	Name string
+	// ExpireAfterSeconds makes it a TTL index, which must have a single date field. MongoDB deletes the documents once
+	// that date plus the given seconds has passed.
+	ExpireAfterSeconds *int32
 }
 
 func setupIndex(coll *mongo.Collection, definition IndexDefinition, unique bool) error {
@@ -103,9 +203,13 @@ func setupIndex(coll *mongo.Collection, definition IndexDefinition, unique bool)
 	if unique {
 		idxName = fmt.Sprintf("%sUniqueIdx", definition.Name)
 	}
+	opts := options.Index().SetName(idxName).SetUnique(unique)
+	if definition.ExpireAfterSeconds != nil {
+		opts.SetExpireAfterSeconds(*definition.ExpireAfterSeconds)
+	}
 	mo := mongo.IndexModel{
 		Keys:    keys,
-		Options: options.Index().SetName(idxName).SetUnique(unique),
+		Options: opts,
 	}
 
 	// Apply the index ... it's ok (no error) even if it already exists
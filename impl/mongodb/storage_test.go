@@ -0,0 +1,40 @@
+package mongodbimpl
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/eliezedeck/gobase/logging"
+	"github.com/eliezedeck/webhook-ingestor/impl/storagetest"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	logging.L = zap.NewNop()
+	os.Exit(m.Run())
+}
+
+// TestStorage needs a MongoDB server, given by the MONGODB_TEST_URI environment variable. Each test has its own
+// database, which is dropped afterwards.
+func TestStorage(t *testing.T) {
+	uri := os.Getenv("MONGODB_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGODB_TEST_URI is not set")
+	}
+
+	storagetest.Run(t, func(t *testing.T) storagetest.Storage {
+		dbname := fmt.Sprintf("webhook-ingestor-test-%d", time.Now().UnixNano())
+		storage, err := NewStorage(uri, dbname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = storage.client.Database(dbname).Drop(context.Background())
+			_ = storage.client.Disconnect(context.Background())
+		})
+		return storage
+	})
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 
-	"github.com/eliezedeck/gobase/random"
 	"github.com/eliezedeck/webhook-ingestor/core"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -12,7 +11,7 @@ import (
 )
 
 func (m *Storage) GetAllWebhooks() ([]*core.Webhook, error) {
-	opts := options.Find().SetSort(bson.D{{"createdAt", OrderASC}})
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: OrderASC}})
 	cur, err := m.collWebhooks.Find(context.Background(), bson.D{}, opts)
 	if err != nil {
 		return nil, err
@@ -27,7 +26,7 @@ func (m *Storage) GetAllWebhooks() ([]*core.Webhook, error) {
 
 func (m *Storage) GetWebhook(id string) (*core.Webhook, error) {
 	var webhook core.Webhook
-	err := m.collWebhooks.FindOne(context.Background(), bson.D{{"_id", id}}).Decode(&webhook)
+	err := m.collWebhooks.FindOne(context.Background(), bson.D{{Key: "_id", Value: id}}).Decode(&webhook)
 	if err == mongo.ErrNoDocuments {
 		return nil, nil
 	}
@@ -40,7 +39,7 @@ func (m *Storage) AddWebhook(webhook *core.Webhook) error {
 }
 
 func (m *Storage) RemoveWebhook(id string) error {
-	_, err := m.collWebhooks.DeleteOne(context.Background(), bson.D{{"_id", id}})
+	_, err := m.collWebhooks.DeleteOne(context.Background(), bson.D{{Key: "_id", Value: id}})
 	return err
 }
 
@@ -53,25 +52,28 @@ func (m *Storage) UpdateWebhook(webhook *core.Webhook) error {
 		return fmt.Errorf("webhook with id %s not found", webhook.ID)
 	}
 
-	// Disallow mutation of certain fields
-	if webhook.Path != existing.Path {
-		return fmt.Errorf("cannot update Webhook Path")
-	}
-	if webhook.Method != existing.Method {
-		return fmt.Errorf("cannot update Webhook Method")
-	}
-
-	// Update the rest of the fields
+	// Update the fields, the Webhook is routed again by the caller when its Method or Path changes
 	existing.Name = webhook.Name
+	existing.Method = webhook.Method
+	existing.Path = webhook.Path
 	existing.Enabled = webhook.Enabled
+	existing.Verification = webhook.Verification
+	existing.Retention = webhook.Retention
+	existing.Acknowledge = webhook.Acknowledge
+	existing.Handshakes = webhook.Handshakes
+	existing.Deduplication = webhook.Deduplication
+	existing.Access = webhook.Access
+	existing.MaxBodySize = webhook.MaxBodySize
+	existing.DecompressBodies = webhook.DecompressBodies
+	existing.Source = webhook.Source
 	for _, f := range webhook.ForwardUrls {
 		if f.ID == "" {
 			// New forward URL, generate a random ID
-			f.ID = random.String(8)
+			f.ID = core.RandomString(8)
 		}
 	}
 	existing.ForwardUrls = webhook.ForwardUrls
 
-	_, err = m.collWebhooks.UpdateOne(context.Background(), bson.D{{"_id", webhook.ID}}, bson.D{{"$set", existing}})
+	_, err = m.collWebhooks.UpdateOne(context.Background(), bson.D{{Key: "_id", Value: webhook.ID}}, bson.D{{Key: "$set", Value: existing}})
 	return err
 }
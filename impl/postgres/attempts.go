@@ -0,0 +1,72 @@
+package postgresimpl
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/eliezedeck/webhook-ingestor/core"
+)
+
+func (m *Storage) StoreDeliveryAttempt(attempt *core.DeliveryAttempt) error {
+	var headers []byte
+	if attempt.ResponseHeaders != nil {
+		var err error
+		if headers, err = json.Marshal(attempt.ResponseHeaders); err != nil {
+			return err
+		}
+	}
+
+	body := attempt.ResponseBody
+	if body == nil {
+		body = []byte{} // not NULL
+	}
+
+	_, err := m.db.ExecContext(context.Background(), `INSERT INTO delivery_attempts (id, request_id, webhook_id,
+		forward_url_id, url, number, started_at, latency, status_code, response_headers, response_body,
+		response_body_truncated, error, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`,
+		attempt.ID, attempt.RequestId, attempt.WebhookId, attempt.ForwardUrlId, attempt.Url, attempt.Number,
+		attempt.StartedAt, int64(attempt.Latency), attempt.StatusCode, headers, body,
+		attempt.ResponseBodyTruncated, attempt.Error,
+		sql.NullTime{Time: attempt.ExpiresAt, Valid: !attempt.ExpiresAt.IsZero()})
+	return err
+}
+
+func (m *Storage) GetDeliveryAttempts(requestId string) ([]*core.DeliveryAttempt, error) {
+	rows, err := m.db.QueryContext(context.Background(), `SELECT id, request_id, webhook_id, forward_url_id, url, number,
+		started_at, latency, status_code, response_headers, response_body, response_body_truncated, error, expires_at
+		FROM delivery_attempts WHERE request_id = $1 ORDER BY started_at`, requestId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := make([]*core.DeliveryAttempt, 0, 4)
+	for rows.Next() {
+		var (
+			attempt   core.DeliveryAttempt
+			latency   int64
+			headers   []byte
+			expiresAt sql.NullTime
+		)
+		err := rows.Scan(&attempt.ID, &attempt.RequestId, &attempt.WebhookId, &attempt.ForwardUrlId, &attempt.Url,
+			&attempt.Number, &attempt.StartedAt, &latency, &attempt.StatusCode, &headers, &attempt.ResponseBody,
+			&attempt.ResponseBodyTruncated, &attempt.Error, &expiresAt)
+		if err != nil {
+			return nil, err
+		}
+		attempt.Latency = time.Duration(latency)
+		attempt.ExpiresAt = expiresAt.Time
+		if err := unmarshalNullable(headers, &attempt.ResponseHeaders); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, &attempt)
+	}
+	return attempts, rows.Err()
+}
+
+func (m *Storage) DeleteDeliveryAttempts(requestId string) error {
+	_, err := m.db.ExecContext(context.Background(), `DELETE FROM delivery_attempts WHERE request_id = $1`, requestId)
+	return err
+}
@@ -0,0 +1,200 @@
+package postgresimpl
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/eliezedeck/webhook-ingestor/core"
+)
+
+const requestColumns = `id, method, path, headers, body, forward_url, forward_url_id, from_webhook_id, created_at, status,
+	next_attempt_at, locked_until, attempts, rejection, replay_payload, expires_at, query, body_blob, body_size,
+	content_encoding`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// execer is either the *sql.DB or a *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func scanRequest(row scanner) (*core.Request, error) {
+	var (
+		request                                   core.Request
+		headers, forwardUrl, attempts, replayJSON []byte
+		forwardUrlId                              string
+		expiresAt                                 sql.NullTime
+	)
+	err := row.Scan(&request.ID, &request.Method, &request.Path, &headers, &request.Body, &forwardUrl, &forwardUrlId,
+		&request.FromWebhookId, &request.CreatedAt, &request.Status, &request.NextAttemptAt, &request.LockedUntil,
+		&attempts, &request.Rejection, &replayJSON, &expiresAt, &request.Query, &request.BodyBlob, &request.BodySize,
+		&request.ContentEncoding)
+	if err != nil {
+		return nil, err
+	}
+	request.ExpiresAt = expiresAt.Time
+
+	if err := unmarshalNullable(headers, &request.Headers); err != nil {
+		return nil, err
+	}
+	if err := unmarshalNullable(forwardUrl, &request.ForwardUrl); err != nil {
+		return nil, err
+	}
+	if err := unmarshalNullable(attempts, &request.Attempts); err != nil {
+		return nil, err
+	}
+	if err := unmarshalNullable(replayJSON, &request.ReplayPayload); err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
+
+func scanRequests(rows *sql.Rows, count int) ([]*core.Request, error) {
+	defer rows.Close()
+
+	requests := make([]*core.Request, 0, count)
+	for rows.Next() {
+		request, err := scanRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, request)
+	}
+	return requests, rows.Err()
+}
+
+func unmarshalNullable(data []byte, dest interface{}) error {
+	if data == nil {
+		return nil
+	}
+	return json.Unmarshal(data, dest)
+}
+
+// requestValues returns the values matching requestColumns, in the same order
+func requestValues(request *core.Request) ([]interface{}, error) {
+	headers, err := json.Marshal(request.Headers)
+	if err != nil {
+		return nil, err
+	}
+	attempts, err := json.Marshal(request.Attempts)
+	if err != nil {
+		return nil, err
+	}
+	var forwardUrl, replayJSON []byte
+	forwardUrlId := ""
+	if request.ForwardUrl != nil {
+		forwardUrlId = request.ForwardUrl.ID
+		if forwardUrl, err = json.Marshal(request.ForwardUrl); err != nil {
+			return nil, err
+		}
+	}
+	if request.ReplayPayload != nil {
+		if replayJSON, err = json.Marshal(request.ReplayPayload); err != nil {
+			return nil, err
+		}
+	}
+	body := request.Body
+	if body == nil {
+		body = []byte{} // not NULL
+	}
+
+	return []interface{}{
+		request.ID, request.Method, request.Path, headers, body, forwardUrl, forwardUrlId,
+		request.FromWebhookId, request.CreatedAt, request.Status, request.NextAttemptAt, request.LockedUntil,
+		attempts, request.Rejection, replayJSON, sql.NullTime{Time: request.ExpiresAt, Valid: !request.ExpiresAt.IsZero()},
+		request.Query, request.BodyBlob, request.BodySize,
+		request.ContentEncoding,
+	}, nil
+}
+
+func (m *Storage) insertRequest(ctx context.Context, exec execer, table string, request *core.Request) error {
+	values, err := requestValues(request)
+	if err != nil {
+		return err
+	}
+	_, err = exec.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s (%s) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20)`,
+		table, requestColumns), values...)
+	return err
+}
+
+func (m *Storage) StoreRequest(request *core.Request) error {
+	if request.CreatedAt.IsZero() {
+		request.CreatedAt = time.Now()
+	}
+	return m.insertRequest(context.Background(), m.db, "requests", request)
+}
+
+func (m *Storage) UpdateRequest(request *core.Request) error {
+	values, err := requestValues(request)
+	if err != nil {
+		return err
+	}
+	_, err = m.db.ExecContext(context.Background(), `UPDATE requests SET
+		method = $2, path = $3, headers = $4, body = $5, forward_url = $6, forward_url_id = $7, from_webhook_id = $8,
+		created_at = $9, status = $10, next_attempt_at = $11, locked_until = $12, attempts = $13, rejection = $14,
+		replay_payload = $15, expires_at = $16, query = $17, body_blob = $18, body_size = $19,
+		content_encoding = $20
+		WHERE id = $1`, values...)
+	return err
+}
+
+func (m *Storage) GetOldestRequests(count int) ([]*core.Request, error) {
+	rows, err := m.db.QueryContext(context.Background(),
+		`SELECT `+requestColumns+` FROM requests ORDER BY created_at ASC LIMIT $1`, count)
+	if err != nil {
+		return nil, err
+	}
+	return scanRequests(rows, count)
+}
+
+func (m *Storage) GetNewestRequests(count int) ([]*core.Request, error) {
+	rows, err := m.db.QueryContext(context.Background(),
+		`SELECT `+requestColumns+` FROM requests ORDER BY created_at DESC LIMIT $1`, count)
+	if err != nil {
+		return nil, err
+	}
+	return scanRequests(rows, count)
+}
+
+func (m *Storage) GetRequest(id string) (*core.Request, error) {
+	row := m.db.QueryRowContext(context.Background(), `SELECT `+requestColumns+` FROM requests WHERE id = $1`, id)
+	request, err := scanRequest(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return request, err
+}
+
+func (m *Storage) DeleteRequest(id string) error {
+	_, err := m.db.ExecContext(context.Background(), `DELETE FROM requests WHERE id = $1`, id)
+	return err
+}
+
+func (m *Storage) CountPendingRequests() (int, error) {
+	var count int
+	err := m.db.QueryRowContext(context.Background(), `SELECT COUNT(*) FROM requests WHERE status = $1`,
+		core.RequestStatusPending).Scan(&count)
+	return count, err
+}
+
+func (m *Storage) ClaimPendingRequests(now time.Time, lease time.Duration, count int) ([]*core.Request, error) {
+	// SKIP LOCKED keeps concurrent instances from claiming the same Request
+	rows, err := m.db.QueryContext(context.Background(), `UPDATE requests SET locked_until = $2
+		WHERE id IN (
+			SELECT id FROM requests
+			WHERE status = $3 AND next_attempt_at <= $1 AND locked_until <= $1
+			ORDER BY next_attempt_at ASC
+			LIMIT $4
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+requestColumns, now, now.Add(lease), core.RequestStatusPending, count)
+	if err != nil {
+		return nil, err
+	}
+	return scanRequests(rows, count)
+}
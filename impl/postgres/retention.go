@@ -0,0 +1,63 @@
+package postgresimpl
+
+import (
+	"context"
+	"time"
+
+	"github.com/eliezedeck/webhook-ingestor/core"
+)
+
+func (m *Storage) PurgeExpiredRequests(now time.Time) (int, error) {
+	purged := 0
+	for _, table := range []string{"requests", "dead_letters"} {
+		result, err := m.db.ExecContext(context.Background(),
+			`DELETE FROM `+table+` WHERE expires_at IS NOT NULL AND expires_at <= $1`, now)
+		if err != nil {
+			return purged, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return purged, err
+		}
+		purged += int(n)
+	}
+
+	if _, err := m.db.ExecContext(context.Background(),
+		`DELETE FROM delivery_attempts WHERE expires_at IS NOT NULL AND expires_at <= $1`, now); err != nil {
+		return purged, err
+	}
+	_, err := m.db.ExecContext(context.Background(), `DELETE FROM idempotency_keys WHERE expires_at <= $1`, now)
+	return purged, err
+}
+
+func (m *Storage) TrimRequests(webhookId string, keep int) (int, error) {
+	ctx := context.Background()
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	excess := `SELECT id FROM requests
+		WHERE from_webhook_id = $1 AND status <> $2
+		ORDER BY created_at DESC
+		OFFSET $3`
+
+	// The DeliveryAttempts go along with their Request
+	if _, err := tx.ExecContext(ctx, `DELETE FROM delivery_attempts WHERE request_id IN (`+excess+`)`,
+		webhookId, core.RequestStatusPending, keep); err != nil {
+		return 0, err
+	}
+	result, err := tx.ExecContext(ctx, `DELETE FROM requests WHERE id IN (`+excess+`)`,
+		webhookId, core.RequestStatusPending, keep)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), tx.Commit()
+}
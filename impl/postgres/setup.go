@@ -0,0 +1,176 @@
+package postgresimpl
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/eliezedeck/gobase/logging"
+	_ "github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+type Storage struct {
+	db *sql.DB
+}
+
+func NewStorage(dsn string) (*Storage, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		return nil, err
+	}
+	logging.L.Info("Connected to PostgreSQL")
+
+	// Setup tables and their indexes
+	if err := migrate(db); err != nil {
+		return nil, err
+	}
+	logging.L.Info("Migrations are applied, database is ready")
+
+	return &Storage{
+		db: db,
+	}, nil
+}
+
+// migrations are applied in order, each one only once. Never change an existing migration, append a new one instead.
+var migrations = []string{
+	// 1: initial schema
+	`CREATE TABLE webhooks (
+		id          TEXT PRIMARY KEY,
+		method      TEXT NOT NULL,
+		path        TEXT NOT NULL,
+		enabled     INTEGER NOT NULL,
+		created_at  TIMESTAMPTZ NOT NULL,
+		definition  JSONB NOT NULL
+	);
+	CREATE INDEX webhooks_enabled_idx ON webhooks (enabled);
+	CREATE INDEX webhooks_date_idx ON webhooks (created_at);
+
+	CREATE TABLE requests (
+		id               TEXT PRIMARY KEY,
+		method           TEXT NOT NULL,
+		path             TEXT NOT NULL,
+		headers          JSONB NOT NULL,
+		body             BYTEA NOT NULL,
+		forward_url      JSONB,
+		forward_url_id   TEXT NOT NULL,
+		from_webhook_id  TEXT NOT NULL,
+		created_at       TIMESTAMPTZ NOT NULL,
+		status           TEXT NOT NULL,
+		next_attempt_at  TIMESTAMPTZ NOT NULL,
+		locked_until     TIMESTAMPTZ NOT NULL,
+		attempts         JSONB NOT NULL,
+		rejection        TEXT NOT NULL,
+		replay_payload   JSONB
+	);
+	CREATE INDEX requests_date_idx ON requests (created_at);
+	CREATE INDEX requests_webhook_idx ON requests (from_webhook_id, created_at);
+	CREATE INDEX requests_pending_idx ON requests (status, next_attempt_at);
+
+	CREATE TABLE dead_letters (LIKE requests INCLUDING ALL);
+	CREATE INDEX dead_letters_origin_idx ON dead_letters (from_webhook_id, forward_url_id, created_at);`,
+
+	// 2: retention
+	`ALTER TABLE requests ADD COLUMN expires_at TIMESTAMPTZ;
+	CREATE INDEX requests_expiration_idx ON requests (expires_at) WHERE expires_at IS NOT NULL;
+	ALTER TABLE dead_letters ADD COLUMN expires_at TIMESTAMPTZ;
+	CREATE INDEX dead_letters_expiration_idx ON dead_letters (expires_at) WHERE expires_at IS NOT NULL;`,
+
+	// 3: delivery attempts
+	`CREATE TABLE delivery_attempts (
+		id                       TEXT PRIMARY KEY,
+		request_id               TEXT NOT NULL,
+		webhook_id               TEXT NOT NULL,
+		forward_url_id           TEXT NOT NULL,
+		url                      TEXT NOT NULL,
+		number                   INTEGER NOT NULL,
+		started_at               TIMESTAMPTZ NOT NULL,
+		latency                  BIGINT NOT NULL,
+		status_code              INTEGER NOT NULL,
+		response_headers         JSONB,
+		response_body            BYTEA NOT NULL,
+		response_body_truncated  BOOLEAN NOT NULL,
+		error                    TEXT NOT NULL,
+		expires_at               TIMESTAMPTZ
+	);
+	CREATE INDEX delivery_attempts_request_idx ON delivery_attempts (request_id, started_at);
+	CREATE INDEX delivery_attempts_expiration_idx ON delivery_attempts (expires_at) WHERE expires_at IS NOT NULL;`,
+
+	// 4: query string of the requests
+	`ALTER TABLE requests ADD COLUMN query TEXT NOT NULL DEFAULT '';
+	ALTER TABLE dead_letters ADD COLUMN query TEXT NOT NULL DEFAULT '';`,
+
+	// 5: idempotency keys
+	`CREATE TABLE idempotency_keys (
+		id           TEXT PRIMARY KEY,
+		webhook_id   TEXT NOT NULL,
+		dedup_key    TEXT NOT NULL,
+		request_id   TEXT NOT NULL,
+		status_code  INTEGER NOT NULL,
+		headers      JSONB,
+		body         BYTEA NOT NULL,
+		created_at   TIMESTAMPTZ NOT NULL,
+		expires_at   TIMESTAMPTZ NOT NULL
+	);
+	CREATE INDEX idempotency_keys_expiration_idx ON idempotency_keys (expires_at);`,
+
+	// 6: spooled bodies
+	`ALTER TABLE requests ADD COLUMN body_blob TEXT NOT NULL DEFAULT '';
+	ALTER TABLE requests ADD COLUMN body_size BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE dead_letters ADD COLUMN body_blob TEXT NOT NULL DEFAULT '';
+	ALTER TABLE dead_letters ADD COLUMN body_size BIGINT NOT NULL DEFAULT 0;`,
+
+	// 7: content encoding of the bodies
+	`ALTER TABLE requests ADD COLUMN content_encoding TEXT NOT NULL DEFAULT '';
+	ALTER TABLE dead_letters ADD COLUMN content_encoding TEXT NOT NULL DEFAULT '';`,
+
+	// 8: lease of the idempotency keys, the ones claimed before it can be taken over right away
+	`ALTER TABLE idempotency_keys ADD COLUMN locked_until TIMESTAMPTZ NOT NULL DEFAULT 'epoch';`,
+}
+
+// migrationsLockKey is the key of the advisory lock that keeps concurrent instances from migrating at the same time
+const migrationsLockKey = 7_031_947_251
+
+func migrate(db *sql.DB) error {
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationsLockKey); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version     INTEGER PRIMARY KEY,
+		applied_at  TIMESTAMPTZ NOT NULL
+	)`); err != nil {
+		return err
+	}
+
+	var current int
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+	for i := current; i < len(migrations); i++ {
+		version := i + 1
+		if _, err := tx.ExecContext(ctx, migrations[i]); err != nil {
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, applied_at) VALUES ($1, $2)`, version, time.Now()); err != nil {
+			return err
+		}
+		logging.L.Info("Migration has been applied", zap.Int("version", version))
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,39 @@
+package postgresimpl
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/eliezedeck/gobase/logging"
+	"github.com/eliezedeck/webhook-ingestor/impl/storagetest"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	logging.L = zap.NewNop()
+	os.Exit(m.Run())
+}
+
+// TestStorage needs a PostgreSQL database that can be emptied, given by the POSTGRES_TEST_DSN environment variable
+func TestStorage(t *testing.T) {
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_TEST_DSN is not set")
+	}
+
+	storagetest.Run(t, func(t *testing.T) storagetest.Storage {
+		storage, err := NewStorage(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = storage.db.Close()
+		})
+		if _, err := storage.db.ExecContext(context.Background(),
+			`TRUNCATE webhooks, requests, dead_letters, delivery_attempts, idempotency_keys`); err != nil {
+			t.Fatal(err)
+		}
+		return storage
+	})
+}
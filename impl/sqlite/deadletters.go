@@ -0,0 +1,83 @@
+package sqliteimpl
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/eliezedeck/webhook-ingestor/core"
+)
+
+// deadLetterWhere returns the WHERE clause (possibly empty) and its arguments for the given filter
+func deadLetterWhere(filter core.DeadLetterFilter) (string, []interface{}) {
+	conditions := make([]string, 0, 2)
+	args := make([]interface{}, 0, 2)
+	if filter.WebhookId != "" {
+		args = append(args, filter.WebhookId)
+		conditions = append(conditions, fmt.Sprintf("from_webhook_id = ?%d", len(args)))
+	}
+	if filter.ForwardUrlId != "" {
+		args = append(args, filter.ForwardUrlId)
+		conditions = append(conditions, fmt.Sprintf("forward_url_id = ?%d", len(args)))
+	}
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+func (m *Storage) MoveToDeadLetters(request *core.Request) error {
+	ctx := context.Background()
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if err := m.insertRequest(ctx, tx, "dead_letters", request); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM requests WHERE id = ?1`, request.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m *Storage) GetDeadLetters(filter core.DeadLetterFilter, count int) ([]*core.Request, error) {
+	where, args := deadLetterWhere(filter)
+	args = append(args, count)
+	rows, err := m.db.QueryContext(context.Background(),
+		fmt.Sprintf(`SELECT %s FROM dead_letters%s ORDER BY created_at DESC LIMIT ?%d`, requestColumns, where, len(args)),
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanRequests(rows, count)
+}
+
+func (m *Storage) GetDeadLetter(id string) (*core.Request, error) {
+	row := m.db.QueryRowContext(context.Background(), `SELECT `+requestColumns+` FROM dead_letters WHERE id = ?1`, id)
+	request, err := scanRequest(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return request, err
+}
+
+func (m *Storage) DeleteDeadLetter(id string) error {
+	_, err := m.db.ExecContext(context.Background(), `DELETE FROM dead_letters WHERE id = ?1`, id)
+	return err
+}
+
+func (m *Storage) PurgeDeadLetters(filter core.DeadLetterFilter) (int, error) {
+	where, args := deadLetterWhere(filter)
+	result, err := m.db.ExecContext(context.Background(), `DELETE FROM dead_letters`+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	purged, err := result.RowsAffected()
+	return int(purged), err
+}
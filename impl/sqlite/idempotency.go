@@ -0,0 +1,80 @@
+package sqliteimpl
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/eliezedeck/webhook-ingestor/core"
+)
+
+func (m *Storage) ClaimIdempotencyKey(record *core.IdempotencyRecord, now time.Time) (*core.IdempotencyRecord, error) {
+	ctx := context.Background()
+
+	// Either a new record, or one that has expired but hasn't been purged yet
+	var id string
+	err := m.db.QueryRowContext(ctx, `INSERT INTO idempotency_keys (id, webhook_id, dedup_key, request_id, status_code,
+		headers, body, created_at, expires_at, locked_until) VALUES (?1, ?2, ?3, ?4, 0, NULL, X'', ?5, ?6, ?8)
+		ON CONFLICT (id) DO UPDATE SET webhook_id = excluded.webhook_id, dedup_key = excluded.dedup_key,
+			request_id = excluded.request_id, status_code = 0, headers = NULL, body = X'',
+			created_at = excluded.created_at, expires_at = excluded.expires_at, locked_until = excluded.locked_until
+		WHERE idempotency_keys.expires_at <= ?7
+			OR (idempotency_keys.status_code = 0 AND idempotency_keys.locked_until <= ?7)
+		RETURNING id`,
+		record.ID, record.WebhookId, record.Key, record.RequestId, toNanos(record.CreatedAt), toNanos(record.ExpiresAt),
+		toNanos(now), toNanos(record.LockedUntil)).Scan(&id)
+	if err == nil {
+		return nil, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	var (
+		existing             core.IdempotencyRecord
+		createdAt, expiresAt int64
+		lockedUntil          int64
+		headers, body        []byte
+	)
+	err = m.db.QueryRowContext(ctx, `SELECT id, webhook_id, dedup_key, request_id, status_code, headers, body,
+		created_at, expires_at, locked_until FROM idempotency_keys WHERE id = ?1`, record.ID).Scan(&existing.ID,
+		&existing.WebhookId, &existing.Key, &existing.RequestId, &existing.StatusCode, &headers, &body, &createdAt,
+		&expiresAt, &lockedUntil)
+	if err == sql.ErrNoRows {
+		// Released in the meantime, try again
+		return m.ClaimIdempotencyKey(record, now)
+	}
+	if err != nil {
+		return nil, err
+	}
+	existing.CreatedAt = fromNanos(createdAt)
+	existing.ExpiresAt = fromNanos(expiresAt)
+	existing.LockedUntil = fromNanos(lockedUntil)
+	existing.Body = body
+	if err := unmarshalNullable(headers, &existing.Headers); err != nil {
+		return nil, err
+	}
+	return &existing, nil
+}
+
+func (m *Storage) CompleteIdempotencyKey(record *core.IdempotencyRecord) error {
+	var headers []byte
+	if record.Headers != nil {
+		var err error
+		if headers, err = json.Marshal(record.Headers); err != nil {
+			return err
+		}
+	}
+
+	_, err := m.db.ExecContext(context.Background(),
+		`UPDATE idempotency_keys SET status_code = ?2, headers = ?3, body = ?4 WHERE id = ?1 AND request_id = ?5`,
+		record.ID, record.StatusCode, nullableText(headers), record.Body, record.RequestId)
+	return err
+}
+
+func (m *Storage) ReleaseIdempotencyKey(record *core.IdempotencyRecord) error {
+	_, err := m.db.ExecContext(context.Background(), `DELETE FROM idempotency_keys WHERE id = ?1 AND request_id = ?2`,
+		record.ID, record.RequestId)
+	return err
+}
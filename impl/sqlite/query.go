@@ -0,0 +1,65 @@
+package sqliteimpl
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/eliezedeck/webhook-ingestor/core"
+)
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (m *Storage) QueryRequests(query *core.RequestQuery) ([]*core.Request, error) {
+	conditions := make([]string, 0, 8)
+	args := make([]interface{}, 0, 8)
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("?%d", len(args))
+	}
+
+	if query.WebhookId != "" {
+		conditions = append(conditions, "from_webhook_id = "+arg(query.WebhookId))
+	}
+	if query.ForwardUrlId != "" {
+		conditions = append(conditions, "forward_url_id = "+arg(query.ForwardUrlId))
+	}
+	if query.Method != "" {
+		conditions = append(conditions, "method = "+arg(query.Method))
+	}
+	if query.PathPrefix != "" {
+		conditions = append(conditions, "path LIKE "+arg(likeEscaper.Replace(query.PathPrefix)+"%")+` ESCAPE '\'`)
+	}
+	if !query.Since.IsZero() {
+		conditions = append(conditions, "created_at >= "+arg(toNanos(query.Since)))
+	}
+	if !query.Until.IsZero() {
+		conditions = append(conditions, "created_at < "+arg(toNanos(query.Until)))
+	}
+	if query.Header != "" {
+		conditions = append(conditions, `EXISTS (SELECT 1 FROM json_each(headers, '$."' || `+arg(query.CanonicalHeader())+` || '"') WHERE value = `+arg(query.HeaderValue)+`)`)
+	}
+	if query.Status != "" {
+		conditions = append(conditions, "status = "+arg(query.Status))
+	}
+
+	order, op := "ASC", ">"
+	if query.NewestFirst {
+		order, op = "DESC", "<"
+	}
+	if query.After != nil {
+		conditions = append(conditions, fmt.Sprintf("(created_at, id) %s (%s, %s)", op, arg(toNanos(query.After.CreatedAt)), arg(query.After.ID)))
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+	rows, err := m.db.QueryContext(context.Background(),
+		fmt.Sprintf(`SELECT %s FROM requests%s ORDER BY created_at %s, id %s LIMIT %s`, requestColumns, where, order, order, arg(query.Limit)),
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanRequests(rows, query.Limit)
+}
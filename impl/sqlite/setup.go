@@ -0,0 +1,207 @@
+package sqliteimpl
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/eliezedeck/gobase/logging"
+	"go.uber.org/zap"
+	_ "modernc.org/sqlite"
+)
+
+type Storage struct {
+	db *sql.DB
+}
+
+func NewStorage(path string) (*Storage, error) {
+	// WAL keeps the readers from blocking the writer, the busy timeout makes concurrent writers wait for each other
+	dsn := fmt.Sprintf("file:%s?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)", url.PathEscape(path))
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		return nil, err
+	}
+	logging.L.Info("Opened SQLite database", zap.String("path", path))
+
+	// Setup tables and their indexes
+	if err := migrate(db); err != nil {
+		return nil, err
+	}
+	logging.L.Info("Migrations are applied, database is ready")
+
+	return &Storage{
+		db: db,
+	}, nil
+}
+
+// migrations are applied in order, each one only once. Never change an existing migration, append a new one instead.
+//
+// Times are stored as UNIX nanoseconds so that they sort and compare correctly, 0 being the zero time.Time.
+var migrations = []string{
+	// 1: initial schema
+	`CREATE TABLE webhooks (
+		id          TEXT PRIMARY KEY,
+		method      TEXT NOT NULL,
+		path        TEXT NOT NULL,
+		enabled     INTEGER NOT NULL,
+		created_at  INTEGER NOT NULL,
+		definition  TEXT NOT NULL
+	);
+	CREATE INDEX webhooks_date_idx ON webhooks (created_at);
+
+	CREATE TABLE requests (
+		id               TEXT PRIMARY KEY,
+		method           TEXT NOT NULL,
+		path             TEXT NOT NULL,
+		headers          TEXT NOT NULL,
+		body             BLOB NOT NULL,
+		forward_url      TEXT,
+		forward_url_id   TEXT NOT NULL,
+		from_webhook_id  TEXT NOT NULL,
+		created_at       INTEGER NOT NULL,
+		status           TEXT NOT NULL,
+		next_attempt_at  INTEGER NOT NULL,
+		locked_until     INTEGER NOT NULL,
+		attempts         TEXT NOT NULL,
+		rejection        TEXT NOT NULL,
+		replay_payload   TEXT
+	);
+	CREATE INDEX requests_date_idx ON requests (created_at);
+	CREATE INDEX requests_webhook_idx ON requests (from_webhook_id, created_at);
+	CREATE INDEX requests_pending_idx ON requests (status, next_attempt_at);
+
+	CREATE TABLE dead_letters (
+		id               TEXT PRIMARY KEY,
+		method           TEXT NOT NULL,
+		path             TEXT NOT NULL,
+		headers          TEXT NOT NULL,
+		body             BLOB NOT NULL,
+		forward_url      TEXT,
+		forward_url_id   TEXT NOT NULL,
+		from_webhook_id  TEXT NOT NULL,
+		created_at       INTEGER NOT NULL,
+		status           TEXT NOT NULL,
+		next_attempt_at  INTEGER NOT NULL,
+		locked_until     INTEGER NOT NULL,
+		attempts         TEXT NOT NULL,
+		rejection        TEXT NOT NULL,
+		replay_payload   TEXT
+	);
+	CREATE INDEX dead_letters_date_idx ON dead_letters (created_at);
+	CREATE INDEX dead_letters_origin_idx ON dead_letters (from_webhook_id, forward_url_id, created_at);`,
+
+	// 2: retention
+	`ALTER TABLE requests ADD COLUMN expires_at INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX requests_expiration_idx ON requests (expires_at) WHERE expires_at > 0;
+	ALTER TABLE dead_letters ADD COLUMN expires_at INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX dead_letters_expiration_idx ON dead_letters (expires_at) WHERE expires_at > 0;`,
+
+	// 3: delivery attempts
+	`CREATE TABLE delivery_attempts (
+		id                       TEXT PRIMARY KEY,
+		request_id               TEXT NOT NULL,
+		webhook_id               TEXT NOT NULL,
+		forward_url_id           TEXT NOT NULL,
+		url                      TEXT NOT NULL,
+		number                   INTEGER NOT NULL,
+		started_at               INTEGER NOT NULL,
+		latency                  INTEGER NOT NULL,
+		status_code              INTEGER NOT NULL,
+		response_headers         TEXT,
+		response_body            BLOB NOT NULL,
+		response_body_truncated  INTEGER NOT NULL,
+		error                    TEXT NOT NULL,
+		expires_at               INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX delivery_attempts_request_idx ON delivery_attempts (request_id, started_at);
+	CREATE INDEX delivery_attempts_expiration_idx ON delivery_attempts (expires_at) WHERE expires_at > 0;`,
+
+	// 4: query string of the requests
+	`ALTER TABLE requests ADD COLUMN query TEXT NOT NULL DEFAULT '';
+	ALTER TABLE dead_letters ADD COLUMN query TEXT NOT NULL DEFAULT '';`,
+
+	// 5: idempotency keys
+	`CREATE TABLE idempotency_keys (
+		id           TEXT PRIMARY KEY,
+		webhook_id   TEXT NOT NULL,
+		dedup_key    TEXT NOT NULL,
+		request_id   TEXT NOT NULL,
+		status_code  INTEGER NOT NULL,
+		headers      TEXT,
+		body         BLOB NOT NULL,
+		created_at   INTEGER NOT NULL,
+		expires_at   INTEGER NOT NULL
+	);
+	CREATE INDEX idempotency_keys_expiration_idx ON idempotency_keys (expires_at);`,
+
+	// 6: spooled bodies
+	`ALTER TABLE requests ADD COLUMN body_blob TEXT NOT NULL DEFAULT '';
+	ALTER TABLE requests ADD COLUMN body_size INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE dead_letters ADD COLUMN body_blob TEXT NOT NULL DEFAULT '';
+	ALTER TABLE dead_letters ADD COLUMN body_size INTEGER NOT NULL DEFAULT 0;`,
+
+	// 7: content encoding of the bodies
+	`ALTER TABLE requests ADD COLUMN content_encoding TEXT NOT NULL DEFAULT '';
+	ALTER TABLE dead_letters ADD COLUMN content_encoding TEXT NOT NULL DEFAULT '';`,
+
+	// 8: lease of the idempotency keys, the ones claimed before it can be taken over right away
+	`ALTER TABLE idempotency_keys ADD COLUMN locked_until INTEGER NOT NULL DEFAULT 0;`,
+}
+
+func migrate(db *sql.DB) error {
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version     INTEGER PRIMARY KEY,
+		applied_at  INTEGER NOT NULL
+	)`); err != nil {
+		return err
+	}
+
+	var current int
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+	for i := current; i < len(migrations); i++ {
+		version := i + 1
+		if _, err := tx.ExecContext(ctx, migrations[i]); err != nil {
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, version, time.Now().UnixNano()); err != nil {
+			return err
+		}
+		logging.L.Info("Migration has been applied", zap.Int("version", version))
+	}
+	return tx.Commit()
+}
+
+// toNanos converts to the stored representation of a time.Time
+func toNanos(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromNanos converts back from the stored representation of a time.Time
+func fromNanos(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
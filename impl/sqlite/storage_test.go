@@ -0,0 +1,29 @@
+package sqliteimpl
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/eliezedeck/gobase/logging"
+	"github.com/eliezedeck/webhook-ingestor/impl/storagetest"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	logging.L = zap.NewNop()
+	os.Exit(m.Run())
+}
+
+func TestStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Storage {
+		storage, err := NewStorage(filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = storage.db.Close()
+		})
+		return storage
+	})
+}
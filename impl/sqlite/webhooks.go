@@ -0,0 +1,106 @@
+package sqliteimpl
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/eliezedeck/webhook-ingestor/core"
+)
+
+func (m *Storage) GetAllWebhooks() ([]*core.Webhook, error) {
+	rows, err := m.db.QueryContext(context.Background(), `SELECT definition FROM webhooks ORDER BY created_at ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := make([]*core.Webhook, 0, 10)
+	for rows.Next() {
+		var definition []byte
+		if err := rows.Scan(&definition); err != nil {
+			return nil, err
+		}
+		webhook := &core.Webhook{}
+		if err := json.Unmarshal(definition, webhook); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+func (m *Storage) GetWebhook(id string) (*core.Webhook, error) {
+	var definition []byte
+	err := m.db.QueryRowContext(context.Background(), `SELECT definition FROM webhooks WHERE id = ?1`, id).Scan(&definition)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	webhook := &core.Webhook{}
+	if err := json.Unmarshal(definition, webhook); err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+func (m *Storage) AddWebhook(webhook *core.Webhook) error {
+	definition, err := json.Marshal(webhook)
+	if err != nil {
+		return err
+	}
+	_, err = m.db.ExecContext(context.Background(),
+		`INSERT INTO webhooks (id, method, path, enabled, created_at, definition) VALUES (?1, ?2, ?3, ?4, ?5, ?6)`,
+		webhook.ID, webhook.Method, webhook.Path, webhook.Enabled, toNanos(webhook.CreatedAt), string(definition))
+	return err
+}
+
+func (m *Storage) RemoveWebhook(id string) error {
+	_, err := m.db.ExecContext(context.Background(), `DELETE FROM webhooks WHERE id = ?1`, id)
+	return err
+}
+
+func (m *Storage) UpdateWebhook(webhook *core.Webhook) error {
+	existing, err := m.GetWebhook(webhook.ID)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		return fmt.Errorf("webhook with id %s not found", webhook.ID)
+	}
+
+	// Update the fields, the Webhook is routed again by the caller when its Method or Path changes
+	existing.Name = webhook.Name
+	existing.Method = webhook.Method
+	existing.Path = webhook.Path
+	existing.Enabled = webhook.Enabled
+	existing.Verification = webhook.Verification
+	existing.Retention = webhook.Retention
+	existing.Acknowledge = webhook.Acknowledge
+	existing.Handshakes = webhook.Handshakes
+	existing.Deduplication = webhook.Deduplication
+	existing.Access = webhook.Access
+	existing.MaxBodySize = webhook.MaxBodySize
+	existing.DecompressBodies = webhook.DecompressBodies
+	existing.Source = webhook.Source
+	for _, f := range webhook.ForwardUrls {
+		if f.ID == "" {
+			// New forward URL, generate a random ID
+			f.ID = core.RandomString(8)
+		}
+	}
+	existing.ForwardUrls = webhook.ForwardUrls
+
+	definition, err := json.Marshal(existing)
+	if err != nil {
+		return err
+	}
+	_, err = m.db.ExecContext(context.Background(),
+		`UPDATE webhooks SET method = ?2, path = ?3, enabled = ?4, definition = ?5 WHERE id = ?1`,
+		existing.ID, existing.Method, existing.Path, existing.Enabled, string(definition))
+	return err
+}
@@ -0,0 +1,411 @@
+// Package storagetest is the conformance test of the storages, each of them runs it against itself so that they all
+// behave the same.
+package storagetest
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eliezedeck/webhook-ingestor/core"
+)
+
+// Storage is what the backends implement
+type Storage interface {
+	core.ConfigStorage
+	core.RequestsStorage
+}
+
+// Run runs the whole conformance test, `newStorage` must return an empty Storage each time it is called
+func Run(t *testing.T, newStorage func(t *testing.T) Storage) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, storage Storage)
+	}{
+		{"UpdateWebhook", testUpdateWebhook},
+		{"RemoveWebhook", testRemoveWebhook},
+		{"Requests", testRequests},
+		{"ClaimPendingRequests", testClaimPendingRequests},
+		{"IdempotencyKeys", testIdempotencyKeys},
+		{"TrimRequests", testTrimRequests},
+		{"QueryRequests", testQueryRequests},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStorage(t))
+		})
+	}
+}
+
+// now is rounded to the millisecond, the finest precision of all the backends
+func now() time.Time {
+	return time.Now().Truncate(time.Millisecond)
+}
+
+// NewWebhook returns a valid Webhook with a single Forward URL
+func NewWebhook(id string) *core.Webhook {
+	return &core.Webhook{
+		ID:      id,
+		Name:    id,
+		Enabled: 1,
+		Method:  "POST",
+		Path:    "/" + id,
+		ForwardUrls: []*core.ForwardUrl{
+			{ID: "f-" + id, Url: "http://localhost/" + id, Timeout: core.Duration(time.Second), ReturnAsResponse: 1},
+		},
+		CreatedAt: now(),
+	}
+}
+
+// NewRequest returns a pending Request of the Webhook, created at the given time
+func NewRequest(id, webhookId string, createdAt time.Time) *core.Request {
+	return &core.Request{
+		ID:            id,
+		Method:        "POST",
+		Path:          "/" + webhookId,
+		Headers:       map[string][]string{"Content-Type": {"application/json"}},
+		Body:          []byte(`{"id":"` + id + `"}`),
+		ForwardUrl:    &core.ForwardUrl{ID: "f-" + webhookId, Url: "http://localhost/" + webhookId, Timeout: core.Duration(time.Second)},
+		FromWebhookId: webhookId,
+		CreatedAt:     createdAt,
+		Status:        core.RequestStatusPending,
+		NextAttemptAt: createdAt,
+	}
+}
+
+func testUpdateWebhook(t *testing.T, storage Storage) {
+	if err := storage.AddWebhook(NewWebhook("w-1")); err != nil {
+		t.Fatal(err)
+	}
+
+	update := NewWebhook("w-1")
+	update.Name = "renamed"
+	update.MaxBodySize = 1024
+	update.DecompressBodies = 1
+	update.ForwardUrls = append(update.ForwardUrls, &core.ForwardUrl{Url: "http://localhost/new", Timeout: core.Duration(time.Second)})
+	if err := storage.UpdateWebhook(update); err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := storage.GetWebhook("w-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated == nil {
+		t.Fatal("webhook is gone")
+	}
+	if updated.Name != "renamed" {
+		t.Errorf("Name = %s, want renamed", updated.Name)
+	}
+	if updated.MaxBodySize != 1024 {
+		t.Errorf("MaxBodySize = %d, want 1024", updated.MaxBodySize)
+	}
+	if updated.DecompressBodies != 1 {
+		t.Errorf("DecompressBodies = %d, want 1", updated.DecompressBodies)
+	}
+	if len(updated.ForwardUrls) != 2 || updated.ForwardUrls[1].ID == "" {
+		t.Errorf("the new Forward URL must be stored with an ID: %+v", updated.ForwardUrls)
+	}
+
+	if err := storage.UpdateWebhook(NewWebhook("w-unknown")); err == nil {
+		t.Error("updating an unknown webhook must fail")
+	}
+}
+
+func testRemoveWebhook(t *testing.T, storage Storage) {
+	for _, id := range []string{"w-1", "w-2"} {
+		if err := storage.AddWebhook(NewWebhook(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storage.RemoveWebhook("w-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	webhooks, err := storage.GetAllWebhooks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(webhooks) != 1 || webhooks[0].ID != "w-2" {
+		t.Errorf("webhooks = %v, want only w-2", webhooks)
+	}
+	if w, err := storage.GetWebhook("w-1"); w != nil || err != nil {
+		t.Errorf("GetWebhook of a removed webhook = %v, %v; want nil, nil", w, err)
+	}
+}
+
+func testRequests(t *testing.T, storage Storage) {
+	start := now()
+	for i, id := range []string{"r-1", "r-2", "r-3"} {
+		if err := storage.StoreRequest(NewRequest(id, "w-1", start.Add(time.Duration(i)*time.Second))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	request, err := storage.GetRequest("r-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request == nil || string(request.Body) != `{"id":"r-2"}` || !request.CreatedAt.Equal(start.Add(time.Second)) {
+		t.Fatalf("GetRequest = %+v", request)
+	}
+
+	request.Status = core.RequestStatusDelivered
+	request.Attempts = append(request.Attempts, &core.Attempt{At: start, StatusCode: 200})
+	if err := storage.UpdateRequest(request); err != nil {
+		t.Fatal(err)
+	}
+	if request, err = storage.GetRequest("r-2"); err != nil {
+		t.Fatal(err)
+	}
+	if request.Status != core.RequestStatusDelivered || len(request.Attempts) != 1 {
+		t.Errorf("UpdateRequest has not been stored: %+v", request)
+	}
+
+	oldest, err := storage.GetOldestRequests(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := requestIds(oldest); ids != "r-1 r-2" {
+		t.Errorf("GetOldestRequests = %s, want r-1 r-2", ids)
+	}
+	newest, err := storage.GetNewestRequests(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := requestIds(newest); ids != "r-3 r-2" {
+		t.Errorf("GetNewestRequests = %s, want r-3 r-2", ids)
+	}
+
+	if err := storage.DeleteRequest("r-1"); err != nil {
+		t.Fatal(err)
+	}
+	if request, err := storage.GetRequest("r-1"); request != nil || err != nil {
+		t.Errorf("GetRequest of a deleted request = %v, %v; want nil, nil", request, err)
+	}
+	if count, err := storage.CountPendingRequests(); count != 1 || err != nil {
+		t.Errorf("CountPendingRequests = %d, %v; want 1", count, err)
+	}
+}
+
+func testClaimPendingRequests(t *testing.T, storage Storage) {
+	start := now()
+	for i, id := range []string{"r-1", "r-2", "r-3"} {
+		request := NewRequest(id, "w-1", start.Add(time.Duration(i)*time.Millisecond))
+		if id == "r-3" {
+			request.NextAttemptAt = start.Add(time.Hour)
+		}
+		if err := storage.StoreRequest(request); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	claimed, err := storage.ClaimPendingRequests(start.Add(time.Second), time.Minute, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(claimed, func(i, j int) bool {
+		return claimed[i].ID < claimed[j].ID
+	})
+	if ids := requestIds(claimed); ids != "r-1 r-2" {
+		t.Errorf("ClaimPendingRequests = %s, want r-1 r-2", ids)
+	}
+	// They are leased, the other one isn't due yet
+	if claimed, err = storage.ClaimPendingRequests(start.Add(2*time.Second), time.Minute, 10); len(claimed) != 0 || err != nil {
+		t.Errorf("ClaimPendingRequests during the lease = %s, %v; want none", requestIds(claimed), err)
+	}
+	if claimed, err = storage.ClaimPendingRequests(start.Add(2*time.Minute), time.Minute, 10); len(claimed) != 2 || err != nil {
+		t.Errorf("ClaimPendingRequests after the lease = %s, %v; want r-1 r-2", requestIds(claimed), err)
+	}
+}
+
+func testIdempotencyKeys(t *testing.T, storage Storage) {
+	start := now()
+	record := func(requestId string, at time.Time) *core.IdempotencyRecord {
+		return &core.IdempotencyRecord{
+			ID:          "i-1",
+			WebhookId:   "w-1",
+			Key:         "evt_1",
+			RequestId:   requestId,
+			CreatedAt:   at,
+			ExpiresAt:   at.Add(time.Hour),
+			LockedUntil: at.Add(time.Minute),
+		}
+	}
+	claim := func(r *core.IdempotencyRecord, at time.Time) *core.IdempotencyRecord {
+		t.Helper()
+		original, err := storage.ClaimIdempotencyKey(r, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return original
+	}
+
+	first := record("r-1", start)
+	if original := claim(first, start); original != nil {
+		t.Fatalf("first claim = %+v, want nil", original)
+	}
+	if original := claim(record("r-2", start), start.Add(time.Second)); original == nil ||
+		original.RequestId != "r-1" || original.StatusCode != 0 {
+		t.Fatalf("claim while the original is handled = %+v, want the one of r-1", original)
+	}
+
+	// The original is lost, its lease runs out: the next call takes the key over, the original can't settle it anymore
+	second := record("r-3", start.Add(2*time.Minute))
+	if original := claim(second, second.CreatedAt); original != nil {
+		t.Fatalf("claim after the lease = %+v, want nil", original)
+	}
+	first.StatusCode = 500
+	if err := storage.CompleteIdempotencyKey(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.ReleaseIdempotencyKey(first); err != nil {
+		t.Fatal(err)
+	}
+
+	second.StatusCode = 202
+	second.Headers = map[string][]string{"Content-Type": {"text/plain"}}
+	second.Body = []byte("accepted")
+	if err := storage.CompleteIdempotencyKey(second); err != nil {
+		t.Fatal(err)
+	}
+	// Settled, it holds until it expires
+	original := claim(record("r-4", start.Add(30*time.Minute)), start.Add(30*time.Minute))
+	if original == nil || original.RequestId != "r-3" || original.StatusCode != 202 || string(original.Body) != "accepted" {
+		t.Fatalf("claim once settled = %+v, want the response of r-3", original)
+	}
+	if original := claim(record("r-5", start.Add(2*time.Hour)), start.Add(2*time.Hour)); original != nil {
+		t.Fatalf("claim once expired = %+v, want nil", original)
+	}
+}
+
+func testTrimRequests(t *testing.T, storage Storage) {
+	start := now()
+	for i, id := range []string{"r-1", "r-2", "r-3", "r-4"} {
+		request := NewRequest(id, "w-1", start.Add(time.Duration(i)*time.Second))
+		if id != "r-1" {
+			request.Status = core.RequestStatusDelivered
+		}
+		if err := storage.StoreRequest(request); err != nil {
+			t.Fatal(err)
+		}
+		attempt := &core.DeliveryAttempt{
+			ID:           "a-" + id,
+			RequestId:    id,
+			WebhookId:    "w-1",
+			Number:       1,
+			StartedAt:    request.CreatedAt,
+			ResponseBody: []byte{0x89, 'P', 'N', 'G', 0xff, 0x00},
+		}
+		if err := storage.StoreDeliveryAttempt(attempt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storage.StoreRequest(NewRequest("r-other", "w-2", start)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The pending one is kept whatever its age, and doesn't count
+	if trimmed, err := storage.TrimRequests("w-1", 1); trimmed != 2 || err != nil {
+		t.Fatalf("TrimRequests = %d, %v; want 2", trimmed, err)
+	}
+	for _, tt := range []struct {
+		id   string
+		kept bool
+	}{{"r-1", true}, {"r-2", false}, {"r-3", false}, {"r-4", true}, {"r-other", true}} {
+		request, err := storage.GetRequest(tt.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (request != nil) != tt.kept {
+			t.Errorf("%s kept = %v, want %v", tt.id, request != nil, tt.kept)
+		}
+		if tt.id == "r-other" {
+			continue
+		}
+		attempts, err := storage.GetDeliveryAttempts(tt.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (len(attempts) == 1) != tt.kept {
+			t.Errorf("%s has %d attempts, its request kept = %v", tt.id, len(attempts), tt.kept)
+		}
+		// The response bodies are kept as they are, even when they are not text
+		if len(attempts) == 1 && !bytes.Equal(attempts[0].ResponseBody, []byte{0x89, 'P', 'N', 'G', 0xff, 0x00}) {
+			t.Errorf("%s has the response body %x", tt.id, attempts[0].ResponseBody)
+		}
+	}
+}
+
+func testQueryRequests(t *testing.T, storage Storage) {
+	// Some of them are created at the same time, the ID then breaks the tie
+	start := now()
+	for _, r := range []struct {
+		id, webhookId string
+		at            time.Duration
+	}{
+		{"r-c", "w-1", 0}, {"r-a", "w-1", 0}, {"r-e", "w-1", 2 * time.Second}, {"r-b", "w-1", 0},
+		{"r-d", "w-1", time.Second}, {"r-other", "w-2", time.Second},
+	} {
+		request := NewRequest(r.id, r.webhookId, start.Add(r.at))
+		if r.id == "r-d" {
+			request.Status = core.RequestStatusDelivered
+		}
+		if err := storage.StoreRequest(request); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		query core.RequestQuery
+		want  string
+	}{
+		{"oldest first", core.RequestQuery{WebhookId: "w-1"}, "r-a r-b r-c r-d r-e"},
+		{"newest first", core.RequestQuery{WebhookId: "w-1", NewestFirst: true}, "r-e r-d r-c r-b r-a"},
+		{"all webhooks", core.RequestQuery{}, "r-a r-b r-c r-d r-other r-e"},
+		{"status", core.RequestQuery{Status: core.RequestStatusPending, NewestFirst: true}, "r-e r-other r-c r-b r-a"},
+		{"since and until", core.RequestQuery{Since: start.Add(time.Second), Until: start.Add(2 * time.Second)}, "r-d r-other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Two at a time, the cursor going through the API encoding as it does between the pages
+			query := tt.query
+			query.Limit = 2
+			var ids []string
+			for page := 1; ; page++ {
+				requests, err := storage.QueryRequests(&query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, r := range requests {
+					ids = append(ids, r.ID)
+				}
+				if len(requests) < query.Limit || page > 10 {
+					break
+				}
+				last := requests[len(requests)-1]
+				cursor := &core.RequestCursor{CreatedAt: last.CreatedAt, ID: last.ID, NewestFirst: query.NewestFirst}
+				if query.After, err = core.DecodeRequestCursor(cursor.Encode()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := strings.Join(ids, " "); got != tt.want {
+				t.Errorf("pages = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func requestIds(requests []*core.Request) string {
+	ids := ""
+	for i, r := range requests {
+		if i > 0 {
+			ids += " "
+		}
+		ids += r.ID
+	}
+	return ids
+}
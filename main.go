@@ -1,12 +1,16 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/eliezedeck/gobase/logging"
 	"github.com/eliezedeck/webhook-ingestor/core"
 	"github.com/eliezedeck/webhook-ingestor/impl"
 	mongodbimpl "github.com/eliezedeck/webhook-ingestor/impl/mongodb"
+	postgresimpl "github.com/eliezedeck/webhook-ingestor/impl/postgres"
+	sqliteimpl "github.com/eliezedeck/webhook-ingestor/impl/sqlite"
 	"github.com/eliezedeck/webhook-ingestor/parameters"
 	"github.com/labstack/echo/v4"
 	"go.uber.org/zap"
@@ -22,6 +26,18 @@ func main() {
 
 	// Setup Web server (using Echo)
 	e := buildEcho()
+	var trustedProxies []string
+	if parameters.ParamTrustedProxies != "" {
+		trustedProxies = strings.Split(parameters.ParamTrustedProxies, ",")
+	}
+	if err := core.SetupTrustedProxies(e, trustedProxies); err != nil {
+		panic(err)
+	}
+	if parameters.ParamIPPresetsFile != "" {
+		if err := core.LoadIPPresets(parameters.ParamIPPresetsFile); err != nil {
+			panic(err)
+		}
+	}
 
 	// Setup MemoryStorage instance
 	var (
@@ -30,10 +46,12 @@ func main() {
 	)
 	switch parameters.ParamStorage {
 	case "memory":
-		storage := impl.NewMemoryStorage()
+		storage := impl.NewBoundedMemoryStorage(parameters.ParamMemoryMaxRequests, parameters.ParamMemoryMaxBytes)
 		configStorage = storage
 		reqStorage = storage
-		logging.L.Info("Using in-memory storage")
+		logging.L.Info("Using in-memory storage",
+			zap.Int("maxRequests", parameters.ParamMemoryMaxRequests),
+			zap.Int64("maxBytes", parameters.ParamMemoryMaxBytes))
 	case "mongo":
 		storage, err := mongodbimpl.NewStorage(parameters.ParamStorageMongoUri, parameters.ParamStorageMongoDb)
 		if err != nil {
@@ -42,20 +60,99 @@ func main() {
 		configStorage = storage
 		reqStorage = storage
 		logging.L.Info("Using MongoDB as storage")
+	case "postgres":
+		storage, err := postgresimpl.NewStorage(parameters.ParamStoragePostgresDsn)
+		if err != nil {
+			panic(err)
+		}
+		configStorage = storage
+		reqStorage = storage
+		logging.L.Info("Using PostgreSQL as storage")
+	case "sqlite":
+		storage, err := sqliteimpl.NewStorage(parameters.ParamStoragePath)
+		if err != nil {
+			panic(err)
+		}
+		configStorage = storage
+		reqStorage = storage
+		logging.L.Info("Using SQLite as storage", zap.String("path", parameters.ParamStoragePath))
 	default:
-		panic("invalid -storage parameter, valid values are 'memory' and 'mongo'")
+		panic("invalid -storage parameter, valid values are 'memory', 'mongo', 'postgres' and 'sqlite'")
+	}
+
+	reqStorage = core.InstrumentRequestsStorage(reqStorage)
+	if err := core.SetupTracing(core.TracingOptions{
+		Exporter:     parameters.ParamTracing,
+		OtlpEndpoint: parameters.ParamTracingOtlpEndpoint,
+		OtlpInsecure: parameters.ParamTracingOtlpInsecure,
+		File:         parameters.ParamTracingFile,
+	}); err != nil {
+		panic(err)
 	}
 
 	// -----------
+	// Declarative Webhooks, they are synced before anything is served
+	if parameters.ParamConfigFile != "" {
+		declared, err := core.LoadConfigFile(parameters.ParamConfigFile)
+		if err != nil {
+			panic(err)
+		}
+		plan, err := core.PlanConfig(configStorage, declared)
+		if err != nil {
+			panic(err)
+		}
+		if parameters.ParamConfigDryRun {
+			fmt.Print(plan)
+			return
+		}
+		if err := core.ApplyConfigPlan(configStorage, plan); err != nil {
+			panic(err)
+		}
+		logging.L.Info("Config file has been applied", zap.String("path", parameters.ParamConfigFile),
+			zap.Int("added", len(plan.Add)),
+			zap.Int("updated", len(plan.Update)),
+			zap.Int("removed", len(plan.Remove)))
+	} else if parameters.ParamConfigDryRun {
+		panic("-config-dry-run requires -config")
+	}
+
+	// -----------
+	core.MaxBodySize = parameters.ParamMaxBodySize
+	if parameters.ParamSpoolDir != "" {
+		blobs, err := impl.NewDiskBlobStorage(parameters.ParamSpoolDir)
+		if err != nil {
+			panic(err)
+		}
+		core.SetupBodySpool(blobs, parameters.ParamSpoolThreshold)
+	}
+
+	// -----------
+	if parameters.ParamRetentionMaxAge > 0 || parameters.ParamRetentionMaxCount > 0 || parameters.ParamRetentionFailedMaxAge > 0 {
+		core.DefaultRetention = &core.RetentionPolicy{
+			MaxAge:       core.Duration(parameters.ParamRetentionMaxAge),
+			MaxCount:     parameters.ParamRetentionMaxCount,
+			FailedMaxAge: core.Duration(parameters.ParamRetentionFailedMaxAge),
+		}
+		if err := core.DefaultRetention.Verify(); err != nil {
+			panic(err)
+		}
+	}
+	core.StartRetentionJanitor(configStorage, reqStorage, parameters.ParamRetentionInterval)
+	core.StartDeliveryWorkers(configStorage, reqStorage, parameters.ParamDeliveryWorkers)
 	setupWebhookPaths(e, configStorage, reqStorage)
+	if parameters.ParamConfigFile != "" {
+		if err := core.WatchConfigFile(configStorage, parameters.ParamConfigFile); err != nil {
+			panic(err)
+		}
+	}
 
 	// -----------
 	// Set up the Admin paths
 	if parameters.ParamListen == parameters.ParamAdminListen {
-		core.SetupAdministration(e, e, configStorage, reqStorage, parameters.ParamAdminPath)
+		core.SetupAdministration(e, configStorage, reqStorage, parameters.ParamAdminPath)
 	} else {
 		a := buildEcho()
-		core.SetupAdministration(e, a, configStorage, reqStorage, parameters.ParamAdminPath)
+		core.SetupAdministration(a, configStorage, reqStorage, parameters.ParamAdminPath)
 		go func() {
 			panic(a.Start(parameters.ParamAdminListen))
 		}()
@@ -94,8 +191,9 @@ func setupWebhookPaths(e *echo.Echo, config core.ConfigStorage, reqStore core.Re
 	}
 
 	for _, webhook := range w {
-		if err = webhook.RegisterWithEcho(e, reqStore); err != nil {
+		if err = core.RegisterWebhook(webhook); err != nil {
 			panic(err)
 		}
 	}
+	core.SetupWebhookRouter(e, reqStore)
 }
@@ -3,6 +3,7 @@ package parameters
 import (
 	"flag"
 	"os"
+	"time"
 
 	"github.com/eliezedeck/gobase/logging"
 	"go.uber.org/zap"
@@ -19,6 +20,35 @@ var (
 	ParamStorage         = "memory"
 	ParamStorageMongoUri = "mongodb://localhost:27017"
 	ParamStorageMongoDb  = "WebhookIngestor"
+
+	ParamMemoryMaxRequests = 0
+	ParamMemoryMaxBytes    = int64(0)
+
+	ParamStoragePostgresDsn = "postgres://localhost:5432/webhook_ingestor?sslmode=disable"
+
+	ParamStoragePath = "./data.db"
+
+	ParamDeliveryWorkers = 4
+
+	ParamRetentionMaxAge       = time.Duration(0)
+	ParamRetentionMaxCount     = 0
+	ParamRetentionFailedMaxAge = time.Duration(0)
+	ParamRetentionInterval     = 1 * time.Minute
+
+	ParamConfigFile   = ""
+	ParamConfigDryRun = false
+
+	ParamTracing             = "none"
+	ParamTracingOtlpEndpoint = ""
+	ParamTracingOtlpInsecure = false
+	ParamTracingFile         = ""
+
+	ParamIPPresetsFile  = ""
+	ParamTrustedProxies = ""
+
+	ParamMaxBodySize    = int64(32 << 20)
+	ParamSpoolThreshold = int64(1 << 20)
+	ParamSpoolDir       = ""
 )
 
 func ParseFlags() {
@@ -28,12 +58,36 @@ func ParseFlags() {
 	flag.StringVar(&ParamAdminPassword, "password", ParamAdminPassword, "Password for admin; defaults to 'admin'")
 	flag.StringVar(&ParamAdminPath, "admin-path", ParamAdminPath, "Path for admin; defaults to '__admin__'")
 	flag.StringVar(&ParamStorage, "storage", ParamStorage, "Storage type; defaults to 'memory'")
+	flag.IntVar(&ParamMemoryMaxRequests, "memory-max-requests", ParamMemoryMaxRequests, "Maximum number of requests kept by the memory storage, the oldest are evicted unless they are pending; defaults to 0 (unlimited)")
+	flag.Int64Var(&ParamMemoryMaxBytes, "memory-max-bytes", ParamMemoryMaxBytes, "Maximum size in bytes of the requests kept by the memory storage, the oldest are evicted unless they are pending; defaults to 0 (unlimited)")
 	flag.StringVar(&ParamStorageMongoUri, "mongo-uri", ParamStorageMongoUri, "MongoDB URI; defaults to 'mongodb://localhost:27017'")
 	flag.StringVar(&ParamStorageMongoDb, "mongo-db", ParamStorageMongoDb, "MongoDB database to use; defaults to 'webhook-ingestor'")
+	flag.StringVar(&ParamStoragePostgresDsn, "postgres-dsn", ParamStoragePostgresDsn, "PostgreSQL DSN; defaults to 'postgres://localhost:5432/webhook_ingestor?sslmode=disable'")
+	flag.StringVar(&ParamStoragePath, "storage-path", ParamStoragePath, "Path of the SQLite database file; defaults to './data.db'")
+	flag.IntVar(&ParamDeliveryWorkers, "delivery-workers", ParamDeliveryWorkers, "Number of background workers retrying failed forwards; defaults to 4")
+	flag.DurationVar(&ParamRetentionMaxAge, "retention-max-age", ParamRetentionMaxAge, "Default maximum age of the stored requests, e.g. 72h; defaults to 0 (forever)")
+	flag.IntVar(&ParamRetentionMaxCount, "retention-max-count", ParamRetentionMaxCount, "Default maximum number of stored requests per webhook; defaults to 0 (unlimited)")
+	flag.DurationVar(&ParamRetentionFailedMaxAge, "retention-failed-max-age", ParamRetentionFailedMaxAge, "Default maximum age of the dead letters and rejected requests; defaults to 0 (forever)")
+	flag.DurationVar(&ParamRetentionInterval, "retention-interval", ParamRetentionInterval, "Interval between retention runs, 0 disables them; defaults to 1m")
+	flag.StringVar(&ParamConfigFile, "config", ParamConfigFile, "YAML or JSON file declaring the webhooks, synced at startup and whenever it changes; defaults to none")
+	flag.BoolVar(&ParamConfigDryRun, "config-dry-run", ParamConfigDryRun, "Print the changes that the -config file would make to the webhooks, then exit")
+	flag.StringVar(&ParamTracing, "tracing", ParamTracing, "Exporter of the OpenTelemetry traces: 'none', 'otlp' or 'stdout'; defaults to 'none'")
+	flag.StringVar(&ParamTracingOtlpEndpoint, "tracing-otlp-endpoint", ParamTracingOtlpEndpoint, "host:port of the OTLP/HTTP collector; defaults to the OTEL_EXPORTER_OTLP_* environment variables, or localhost:4318")
+	flag.BoolVar(&ParamTracingOtlpInsecure, "tracing-otlp-insecure", ParamTracingOtlpInsecure, "Use plain HTTP to reach the OTLP collector")
+	flag.StringVar(&ParamTracingFile, "tracing-file", ParamTracingFile, "File where the 'stdout' exporter writes the traces; defaults to the standard output")
+	flag.StringVar(&ParamIPPresetsFile, "ip-presets", ParamIPPresetsFile, "YAML or JSON file of named CIDR lists that the webhooks can allow, e.g. the published ranges of GitHub or Stripe; defaults to none")
+	flag.StringVar(&ParamTrustedProxies, "trusted-proxies", ParamTrustedProxies, "Comma-separated CIDRs of the proxies whose X-Forwarded-For header is trusted for the IP of the callers; defaults to none")
+	flag.Int64Var(&ParamMaxBodySize, "max-body-size", ParamMaxBodySize, "Maximum size in bytes of the bodies of the calls to the Webhooks that don't have their own, 413 beyond it; 0 for unlimited; defaults to 32 MiB")
+	flag.Int64Var(&ParamSpoolThreshold, "spool-threshold", ParamSpoolThreshold, "Bodies larger than this, in bytes, are spooled to the -spool-dir instead of being kept in memory and in the storage; defaults to 1 MiB")
+	flag.StringVar(&ParamSpoolDir, "spool-dir", ParamSpoolDir, "Directory of the spooled bodies, it must be shared by all the instances; defaults to none, the bodies are never spooled")
 	flag.Parse()
 
 	if ParamStorageMongoUri == "MONGO_URI" {
 		ParamStorageMongoUri = os.Getenv("MONGO_URI")
 		logging.L.Info("Using MONGO_URI from the environment", zap.String("uri", ParamStorageMongoUri))
 	}
+	if ParamStoragePostgresDsn == "POSTGRES_DSN" {
+		ParamStoragePostgresDsn = os.Getenv("POSTGRES_DSN")
+		logging.L.Info("Using POSTGRES_DSN from the environment")
+	}
 }